@@ -0,0 +1,95 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// How many annotations are kept. Each is a series of latency_annotation, so this bounds
+// the metric's cardinality.
+const maxAnnotations = 20
+
+// the longest annotation text accepted, as it ends up in a label
+const maxAnnotationLength = 200
+
+// An operational event, such as a deploy or a failover, recorded so it can be lined up
+// with the latency readings around it
+type annotation struct {
+	Time time.Time `json:"time"`
+	Text string    `json:"text"`
+}
+
+var annotationsMu sync.Mutex
+var annotations []annotation // oldest first
+
+var annotationTime = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "latency_annotation",
+		Help: "Unix time of each recent annotation posted to /annotate",
+	},
+	[]string{"text"},
+)
+
+// Record an annotation, dropping the oldest once there are more than maxAnnotations. Texts
+// are the label, so reposting a text moves its series to the new time.
+func annotate(text string) annotation {
+	a := annotation{Time: time.Now().UTC(), Text: text}
+	annotationsMu.Lock()
+	defer annotationsMu.Unlock()
+	for i, old := range annotations {
+		if old.Text == text {
+			annotations = append(annotations[:i], annotations[i+1:]...)
+			break
+		}
+	}
+	annotations = append(annotations, a)
+	if len(annotations) > maxAnnotations {
+		annotationTime.DeleteLabelValues(annotations[0].Text)
+		annotations = annotations[1:]
+	}
+	annotationTime.WithLabelValues(text).Set(float64(a.Time.UnixNano()) / 1e9)
+	return a
+}
+
+// the recent annotations, oldest first
+func recentAnnotations() []annotation {
+	annotationsMu.Lock()
+	defer annotationsMu.Unlock()
+	return append([]annotation(nil), annotations...)
+}
+
+// handler for POST /annotate, recording the annotation whose text is in the JSON body
+func postAnnotation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(w, r) {
+		return
+	}
+	var body struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body.Text) == 0 || len(body.Text) > maxAnnotationLength {
+		http.Error(w, fmt.Sprintf("text must be 1 to %d bytes", maxAnnotationLength), http.StatusBadRequest)
+		return
+	}
+	a := annotate(body.Text)
+	log.Printf("Annotation from %s: %s", r.RemoteAddr, a.Text)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
@@ -0,0 +1,114 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// 1 when the peer reports a current reading of its own towards us, 0 when it can't or won't
+var bidirectionalOk = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "latency_bidirectional_ok",
+		Help: "Whether the region also reports a live latency reading back to this region",
+	},
+	[]string{"to"},
+)
+
+// Check every region that can be reached through the ping protocol concurrently, once per
+// region refresh. Each check is an http request, so running them in the prober would hold up
+// the probe cycle.
+func checkAllBidirectional() {
+	var wg sync.WaitGroup
+	for _, r := range snapshotRegions() {
+		if r.external() {
+			continue
+		}
+		wg.Add(1)
+		go func(r *regionData) {
+			defer wg.Done()
+			checkBidirectional(r)
+		}(r)
+	}
+	wg.Wait()
+}
+
+// whether our own probes of the region currently succeed, with a reading within the stats
+// window and no failure since
+func (r *regionData) reachable() bool {
+	regionsMu.RLock()
+	defer regionsMu.RUnlock()
+	return r.failures == 0 && !math.IsNaN(r.last) && time.Since(r.lastUpdate) < conf().StatsWindow
+}
+
+// Ask the peer's http endpoint for its latencies and check that it has a live reading towards
+// us. Our probe reaching the peer says nothing about the reverse path, which symmetric
+// services depend on too. Both directions have to work, so while our own probes of the
+// region fail it isn't asked at all.
+func checkBidirectional(r *regionData) {
+	if !r.reachable() {
+		bidirectionalOk.WithLabelValues(r.region).Set(0)
+		return
+	}
+	c := conf()
+	ctx, cancel := context.WithTimeout(context.Background(), c.LatencyRefreshRate)
+	defer cancel()
+	port := c.HttpPort
+	if c.MultiplexPorts {
+		port = c.TcpPort
+	}
+	url := fmt.Sprintf("http://%s.%s.internal:%s/", r.region, appName, port)
+	ok, err := peerReachesUs(ctx, url)
+	if err != nil {
+		log.Printf("Unable to verify that %s can reach %s: %v", r.region, currRegion, err)
+	}
+	if ok {
+		bidirectionalOk.WithLabelValues(r.region).Set(1)
+	} else {
+		bidirectionalOk.WithLabelValues(r.region).Set(0)
+	}
+}
+
+// Parse the peer's tab separated latencies looking for a usable reading to currRegion. A
+// reading the peer marks stale stands in for one it can't currently take, so it doesn't count.
+func peerReachesUs(ctx context.Context, url string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 3 || fields[1] != currRegion {
+			continue
+		}
+		if len(fields) > 3 && fields[3] == "stale" {
+			return false, nil
+		}
+		// a region without a reading is written as NaN
+		latency, err := strconv.ParseFloat(fields[2], 64)
+		return err == nil && !math.IsNaN(latency) && latency > 0, nil
+	}
+	return false, scanner.Err()
+}
@@ -0,0 +1,80 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The first handshake version whose servers understand the binary handshake
+const binaryVersion = 4
+
+// Formats of the handshake a client can send, see HandshakeFormat
+const (
+	formatText   = "text"
+	formatBinary = "binary"
+)
+
+// Starts every binary handshake. It can't begin a text announcement, whose first byte is
+// ASCII, or an http request, so a server can tell the formats apart from the first byte.
+const binaryMagic = 0xb1
+
+// A handshake message in the binary format: the magic byte, then one byte each for the
+// version and the region's length, the region, and one byte for the token's length followed
+// by the token, which is empty unless the client has one. Lengths make partial reads
+// detectable and nothing depends on line endings.
+type binaryHello struct {
+	version int
+	region  string
+	token   string
+}
+
+func (h binaryHello) encode() ([]byte, error) {
+	if h.version < 0 || h.version > 255 || len(h.region) > 255 || len(h.token) > 255 {
+		return nil, errors.New("binary handshake fields must each fit in 255 bytes")
+	}
+	buf := make([]byte, 0, 5+len(h.region)+len(h.token))
+	buf = append(buf, binaryMagic, byte(h.version), byte(len(h.region)))
+	buf = append(buf, h.region...)
+	buf = append(buf, byte(len(h.token)))
+	buf = append(buf, h.token...)
+	return buf, nil
+}
+
+// whether the peer's next message is a binary handshake, waiting for it to start arriving
+func speaksBinary(rd *bufio.Reader) (bool, error) {
+	b, err := rd.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	return b[0] == binaryMagic, nil
+}
+
+func readBinaryHello(rd *bufio.Reader) (binaryHello, error) {
+	var header [3]byte
+	if _, err := io.ReadFull(rd, header[:]); err != nil {
+		return binaryHello{}, err
+	}
+	if header[0] != binaryMagic {
+		return binaryHello{}, fmt.Errorf("binary handshake starts with %#x", header[0])
+	}
+	region := make([]byte, header[2])
+	if _, err := io.ReadFull(rd, region); err != nil {
+		return binaryHello{}, err
+	}
+	n, err := rd.ReadByte()
+	if err != nil {
+		return binaryHello{}, err
+	}
+	token := make([]byte, n)
+	if _, err := io.ReadFull(rd, token); err != nil {
+		return binaryHello{}, err
+	}
+	if err := validateRegion(string(region)); err != nil {
+		return binaryHello{}, fmt.Errorf("binary handshake: %w", err)
+	}
+	return binaryHello{version: int(header[1]), region: string(region), token: string(token)}, nil
+}
@@ -0,0 +1,466 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// config holds every tunable setting. The active config is replaced wholesale on reload so
+// readers always see a consistent set of values.
+type config struct {
+	TcpPort            string
+	HttpPort           string // empty serves no http endpoints, unless MultiplexPorts is set
+	MultiplexPorts     bool   // serve http on TcpPort alongside the ping server, ignoring HttpPort
+	ServerAnnounce     string // when the ping server announces itself, announceFirst or announceAfterClient
+	ReverseProbes      bool   // have the ping server probe clients back over their connection
+	HandshakeFormat    string // formatText or formatBinary, used once a server is known to understand it
+	HandshakeToken     string // shared secret peers must present after their announcement, open when empty
+	RegionRefreshRate  time.Duration
+	LatencyRefreshRate time.Duration
+	LegacyMetricNames  bool
+	// when set, pairs not involving this region are only probed every ReplicaProbeInterval
+	PrimaryRegion        string
+	ReplicaProbeInterval time.Duration
+	// probe stable regions less often and noisy ones more often, within these bounds; a zero
+	// maximum disables adaptation and a zero minimum is LatencyRefreshRate
+	AdaptiveMinInterval time.Duration
+	AdaptiveMaxInterval time.Duration
+	ProbeSampleSize     int     // probe this many random regions per tick, 0 probes them all
+	PipelineTargets     int     // probe up to this many regions sharing a peer address over one connection
+	ProbeDebugLog       bool    // log a timing breakdown of every probe
+	ProbeSourcePort     int     // pin probes to this source port so they keep to one path, 0 lets the kernel pick
+	PathChangeThreshold float64 // relative RTT shift that counts as a path change, 0 disables detection
+	StableProbes        int     // probe a region up to this many times per tick until its RTT settles, 0 or 1 probes once
+	StableTolerance     float64 // relative difference within which consecutive readings count as settled
+	// only display a region's latest reading while QuorumSize of its last QuorumProbes probes
+	// succeeded, and its last stable one otherwise; a zero QuorumSize always displays the latest
+	QuorumSize    int
+	QuorumProbes  int
+	SourceZone    string        // finer grained location of this host within its region, labelled from_zone
+	ProbeDscp     int           // DSCP to mark probe packets with, 0 for the default class
+	OverlayMtu    int           // clamp probe segments to this MTU and track fragmentation, 0 leaves them alone
+	StatsWindow   time.Duration // span of every in-process windowed statistic
+	StatsRingSize int           // samples kept per region for the windowed statistics, 0 sizes to StatsWindow
+	// discard TCP_INFO readings below this as kernel artifacts rather than network latency
+	MinRttMicroseconds int
+	// clear the last reading of a region after this many consecutive failures, 0 never does
+	CollapseAfterFailures int
+	// ignore failures of a region for this long after it is discovered, 0 never does
+	DiscoveryGrace     time.Duration
+	BidirectionalCheck bool          // on each region refresh, check the peers can reach us too
+	DnsChainMetrics    bool          // inspect the CNAME chain of each region's hostname on refresh
+	DnsCacheTtl        time.Duration // reuse probe targets' resolved addresses for this long, 0 resolves every probe
+	// start the windowed statistics afresh when a region's hostname resolves to a new address
+	IpChangeResetsWindow bool
+	UnmapIPv4            bool   // report IPv4-mapped IPv6 peer addresses in their IPv4 form
+	RegionCase           string // case region names are normalized to, so peers can't fragment a region
+	// comma separated SRV names of external services to probe, by connecting only
+	SrvServices      string
+	SrvAllPriorities bool   // probe every SRV target rather than only the highest priority ones
+	TargetsFile      string // where static targets added through /targets are saved, not saved when empty
+
+	StdoutReportInterval time.Duration // write the latency matrix to stdout this often, 0 never does
+	TextfilePath         string        // also write the metrics to this .prom file, disabled when empty
+	TextfileInterval     time.Duration
+	WarmupPeriod         time.Duration // discard readings for this long after starting, 0 keeps them all
+
+	InfluxUrl           string // export readings to this InfluxDB, disabled when empty
+	InfluxBucket        string
+	InfluxOrg           string
+	InfluxToken         string
+	InfluxBatchSize     int
+	InfluxFlushInterval time.Duration
+
+	KafkaBrokers string // comma separated broker addresses to publish readings to, disabled when empty
+	KafkaTopic   string
+
+	OtlpEndpoint       string // export readings to this OTLP/HTTP metrics URL, disabled when empty
+	OtlpTemporality    string // cumulative or delta
+	OtlpExportInterval time.Duration
+
+	ConfigAuthToken string // bearer token required by /config, /pause, /resume, /targets and /annotate, open when empty
+
+	// classic buckets per latency histogram, 0 keeps the client library default
+	HistogramBuckets int
+	// enables native histograms when greater than 1, see prometheus.HistogramOpts
+	NativeHistogramBucketFactor float64
+	NativeHistogramMaxBuckets   int // 0 leaves native histograms unbounded
+
+	// unix.TCPInfo fields exported as gauges, see parseTcpInfoFields
+	TcpInfoFields string
+	tcpInfoFields []int
+
+	// per-region latency objectives, see parseSloTargets
+	SloTargets string
+	sloTargets map[string]sloTarget
+
+	raw map[string]string // the unparsed value of every setting that was set
+}
+
+func defaultConfig() *config {
+	return &config{
+		TcpPort:              "10000",
+		HttpPort:             "9091",
+		ServerAnnounce:       announceFirst,
+		HandshakeFormat:      formatText,
+		RegionRefreshRate:    10 * time.Second,
+		LatencyRefreshRate:   1 * time.Second,
+		ReplicaProbeInterval: 30 * time.Second,
+		StableTolerance:      0.1,
+		QuorumProbes:         5,
+		UnmapIPv4:            true,
+		RegionCase:           caseLower,
+		StatsWindow:          5 * time.Minute,
+
+		TextfileInterval: 15 * time.Second,
+
+		InfluxBatchSize:     500,
+		InfluxFlushInterval: 10 * time.Second,
+
+		NativeHistogramMaxBuckets: 160,
+
+		KafkaTopic: "latency",
+
+		OtlpTemporality:    "cumulative",
+		OtlpExportInterval: 60 * time.Second,
+	}
+}
+
+// setting describes how a single key in the environment or config file is applied
+type setting struct {
+	name       string // environment variable and config file key
+	reloadable bool   // applied on SIGHUP, otherwise a change only takes effect after a restart
+	set        func(c *config, v string) error
+	get        func(c *config) any // the effective value, for reporting
+	secret     bool                // never reported
+}
+
+// mark a setting as holding a credential
+func secret(s setting) setting {
+	s.secret = true
+	return s
+}
+
+// limit an intSetting to at most max
+func atMost(max int, s setting) setting {
+	set := s.set
+	s.set = func(c *config, v string) error {
+		if i, err := strconv.Atoi(v); err == nil && i > max {
+			return fmt.Errorf("must be at most %d", max)
+		}
+		return set(c, v)
+	}
+	return s
+}
+
+// limit an intSetting to at least min, other than the 0 that turns it off
+func atLeast(min int, s setting) setting {
+	set := s.set
+	s.set = func(c *config, v string) error {
+		if i, err := strconv.Atoi(v); err == nil && i != 0 && i < min {
+			return fmt.Errorf("must be 0 or at least %d", min)
+		}
+		return set(c, v)
+	}
+	return s
+}
+
+var settings = []setting{
+	stringSetting("TCP_PORT", false, func(c *config) *string { return &c.TcpPort }),
+	stringSetting("HTTP_PORT", false, func(c *config) *string { return &c.HttpPort }),
+	boolSetting("MULTIPLEX_PORTS", false, func(c *config) *bool { return &c.MultiplexPorts }),
+	choiceSetting("HANDSHAKE_FORMAT", true, []string{formatText, formatBinary}, func(c *config) *string { return &c.HandshakeFormat }),
+	secret(stringSetting("HANDSHAKE_TOKEN", true, func(c *config) *string { return &c.HandshakeToken })),
+	boolSetting("REVERSE_PROBES", true, func(c *config) *bool { return &c.ReverseProbes }),
+	choiceSetting("SERVER_ANNOUNCE", true, []string{announceFirst, announceAfterClient}, func(c *config) *string { return &c.ServerAnnounce }),
+	durationSetting("REGION_REFRESH_RATE", true, func(c *config) *time.Duration { return &c.RegionRefreshRate }),
+	durationSetting("LATENCY_REFRESH_RATE", true, func(c *config) *time.Duration { return &c.LatencyRefreshRate }),
+	stringSetting("PRIMARY_REGION", true, func(c *config) *string { return &c.PrimaryRegion }),
+	durationSetting("REPLICA_PROBE_INTERVAL", true, func(c *config) *time.Duration { return &c.ReplicaProbeInterval }),
+	boolSetting("LEGACY_METRIC_NAMES", false, func(c *config) *bool { return &c.LegacyMetricNames }),
+	optionalDurationSetting("ADAPTIVE_MIN_INTERVAL", true, func(c *config) *time.Duration { return &c.AdaptiveMinInterval }),
+	optionalDurationSetting("ADAPTIVE_MAX_INTERVAL", true, func(c *config) *time.Duration { return &c.AdaptiveMaxInterval }),
+	intSetting("PROBE_SAMPLE_SIZE", true, func(c *config) *int { return &c.ProbeSampleSize }),
+	intSetting("PIPELINE_TARGETS", true, func(c *config) *int { return &c.PipelineTargets }),
+	boolSetting("PROBE_DEBUG_LOG", true, func(c *config) *bool { return &c.ProbeDebugLog }),
+	atMost(65535, intSetting("PROBE_SOURCE_PORT", true, func(c *config) *int { return &c.ProbeSourcePort })),
+	floatSetting("PATH_CHANGE_THRESHOLD", true, func(c *config) *float64 { return &c.PathChangeThreshold }),
+	intSetting("STABLE_PROBES", true, func(c *config) *int { return &c.StableProbes }),
+	floatSetting("STABLE_TOLERANCE", true, func(c *config) *float64 { return &c.StableTolerance }),
+	intSetting("QUORUM_SIZE", true, func(c *config) *int { return &c.QuorumSize }),
+	intSetting("QUORUM_PROBES", true, func(c *config) *int { return &c.QuorumProbes }),
+	stringSetting("SOURCE_ZONE", false, func(c *config) *string { return &c.SourceZone }),
+	atMost(63, intSetting("PROBE_DSCP", false, func(c *config) *int { return &c.ProbeDscp })),
+	atLeast(minOverlayMtu, intSetting("OVERLAY_MTU", true, func(c *config) *int { return &c.OverlayMtu })),
+	sloSetting("SLO_TARGETS", true),
+	tcpInfoFieldsSetting("TCPINFO_FIELDS", false),
+	intSetting("STATS_RING_SIZE", false, func(c *config) *int { return &c.StatsRingSize }),
+	durationSetting("STATS_WINDOW", false, func(c *config) *time.Duration { return &c.StatsWindow }),
+	intSetting("MIN_RTT_MICROSECONDS", true, func(c *config) *int { return &c.MinRttMicroseconds }),
+	intSetting("COLLAPSE_AFTER_FAILURES", true, func(c *config) *int { return &c.CollapseAfterFailures }),
+	optionalDurationSetting("DISCOVERY_GRACE", true, func(c *config) *time.Duration { return &c.DiscoveryGrace }),
+	boolSetting("BIDIRECTIONAL_CHECK", true, func(c *config) *bool { return &c.BidirectionalCheck }),
+	optionalDurationSetting("DNS_CACHE_TTL", true, func(c *config) *time.Duration { return &c.DnsCacheTtl }),
+	boolSetting("IP_CHANGE_RESETS_WINDOW", true, func(c *config) *bool { return &c.IpChangeResetsWindow }),
+	boolSetting("DNS_CHAIN_METRICS", true, func(c *config) *bool { return &c.DnsChainMetrics }),
+	boolSetting("UNMAP_IPV4", true, func(c *config) *bool { return &c.UnmapIPv4 }),
+	choiceSetting("REGION_CASE", false, []string{caseLower, caseUpper, casePreserve}, func(c *config) *string { return &c.RegionCase }),
+	stringSetting("SRV_SERVICES", true, func(c *config) *string { return &c.SrvServices }),
+	boolSetting("SRV_ALL_PRIORITIES", true, func(c *config) *bool { return &c.SrvAllPriorities }),
+	stringSetting("TARGETS_FILE", false, func(c *config) *string { return &c.TargetsFile }),
+	stringSetting("TEXTFILE_PATH", false, func(c *config) *string { return &c.TextfilePath }),
+	durationSetting("TEXTFILE_INTERVAL", false, func(c *config) *time.Duration { return &c.TextfileInterval }),
+	optionalDurationSetting("WARMUP_PERIOD", false, func(c *config) *time.Duration { return &c.WarmupPeriod }),
+	optionalDurationSetting("STDOUT_REPORT_INTERVAL", false, func(c *config) *time.Duration { return &c.StdoutReportInterval }),
+	stringSetting("INFLUXDB_URL", false, func(c *config) *string { return &c.InfluxUrl }),
+	stringSetting("INFLUXDB_BUCKET", false, func(c *config) *string { return &c.InfluxBucket }),
+	stringSetting("INFLUXDB_ORG", false, func(c *config) *string { return &c.InfluxOrg }),
+	secret(stringSetting("INFLUXDB_TOKEN", false, func(c *config) *string { return &c.InfluxToken })),
+	intSetting("INFLUXDB_BATCH_SIZE", false, func(c *config) *int { return &c.InfluxBatchSize }),
+	durationSetting("INFLUXDB_FLUSH_INTERVAL", false, func(c *config) *time.Duration { return &c.InfluxFlushInterval }),
+	stringSetting("KAFKA_BROKERS", false, func(c *config) *string { return &c.KafkaBrokers }),
+	stringSetting("KAFKA_TOPIC", false, func(c *config) *string { return &c.KafkaTopic }),
+	stringSetting("OTLP_ENDPOINT", false, func(c *config) *string { return &c.OtlpEndpoint }),
+	choiceSetting("OTLP_TEMPORALITY", false, []string{"cumulative", "delta"}, func(c *config) *string { return &c.OtlpTemporality }),
+	durationSetting("OTLP_EXPORT_INTERVAL", false, func(c *config) *time.Duration { return &c.OtlpExportInterval }),
+	secret(stringSetting("CONFIG_AUTH_TOKEN", true, func(c *config) *string { return &c.ConfigAuthToken })),
+	intSetting("HISTOGRAM_BUCKETS", false, func(c *config) *int { return &c.HistogramBuckets }),
+	floatSetting("NATIVE_HISTOGRAM_BUCKET_FACTOR", false, func(c *config) *float64 { return &c.NativeHistogramBucketFactor }),
+	intSetting("NATIVE_HISTOGRAM_MAX_BUCKETS", false, func(c *config) *int { return &c.NativeHistogramMaxBuckets }),
+}
+
+func stringSetting(name string, reloadable bool, field func(*config) *string) setting {
+	return setting{name, reloadable, func(c *config, v string) error {
+		if len(v) == 0 {
+			return fmt.Errorf("must not be empty")
+		}
+		*field(c) = v
+		return nil
+	}, func(c *config) any { return *field(c) }, false}
+}
+
+// a string setting restricted to one of choices
+func choiceSetting(name string, reloadable bool, choices []string, field func(*config) *string) setting {
+	return setting{name, reloadable, func(c *config, v string) error {
+		for _, choice := range choices {
+			if v == choice {
+				*field(c) = v
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %s", strings.Join(choices, ", "))
+	}, func(c *config) any { return *field(c) }, false}
+}
+
+func durationSetting(name string, reloadable bool, field func(*config) *time.Duration) setting {
+	return setting{name, reloadable, func(c *config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return fmt.Errorf("must be positive")
+		}
+		*field(c) = d
+		return nil
+	}, func(c *config) any { return *field(c) }, false}
+}
+
+// like durationSetting, but 0 is allowed and usually turns the feature off
+func optionalDurationSetting(name string, reloadable bool, field func(*config) *time.Duration) setting {
+	return setting{name, reloadable, func(c *config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		if d < 0 {
+			return fmt.Errorf("must not be negative")
+		}
+		*field(c) = d
+		return nil
+	}, func(c *config) any { return *field(c) }, false}
+}
+
+func boolSetting(name string, reloadable bool, field func(*config) *bool) setting {
+	return setting{name, reloadable, func(c *config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = b
+		return nil
+	}, func(c *config) any { return *field(c) }, false}
+}
+
+func intSetting(name string, reloadable bool, field func(*config) *int) setting {
+	return setting{name, reloadable, func(c *config, v string) error {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		if i < 0 {
+			return fmt.Errorf("must not be negative")
+		}
+		*field(c) = i
+		return nil
+	}, func(c *config) any { return *field(c) }, false}
+}
+
+func sloSetting(name string, reloadable bool) setting {
+	return setting{name, reloadable, func(c *config, v string) error {
+		targets, err := parseSloTargets(v)
+		if err != nil {
+			return err
+		}
+		c.SloTargets, c.sloTargets = v, targets
+		return nil
+	}, func(c *config) any { return c.SloTargets }, false}
+}
+
+func tcpInfoFieldsSetting(name string, reloadable bool) setting {
+	return setting{name, reloadable, func(c *config, v string) error {
+		fields, err := parseTcpInfoFields(v)
+		if err != nil {
+			return err
+		}
+		c.TcpInfoFields, c.tcpInfoFields = v, fields
+		return nil
+	}, func(c *config) any { return c.TcpInfoFields }, false}
+}
+
+func floatSetting(name string, reloadable bool, field func(*config) *float64) setting {
+	return setting{name, reloadable, func(c *config, v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return err
+		}
+		if f < 0 {
+			return fmt.Errorf("must not be negative")
+		}
+		*field(c) = f
+		return nil
+	}, func(c *config) any { return *field(c) }, false}
+}
+
+var configFileEnvVar = "CONFIG_FILE"
+
+// read KEY=VALUE lines from the config file, ignoring blank lines and # comments
+func readConfigFile(path string) (map[string]string, error) {
+	values := make(map[string]string)
+	if len(path) == 0 {
+		return values, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, n)
+		}
+		values[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return values, scanner.Err()
+}
+
+// Build a config from the config file and the environment, with the file taking precedence
+// so values can be changed without a restart. When reloading, prev is the running config and
+// any setting that isn't reloadable keeps its previous value.
+func loadConfig(prev *config) (*config, error) {
+	file, err := readConfigFile(os.Getenv(configFileEnvVar))
+	if err != nil {
+		return nil, err
+	}
+
+	c := defaultConfig()
+	c.raw = make(map[string]string)
+	for _, s := range settings {
+		v, ok := file[s.name]
+		if !ok {
+			v, ok = os.LookupEnv(s.name)
+		}
+		if prev != nil && !s.reloadable {
+			pv, pok := prev.raw[s.name]
+			if v != pv || ok != pok {
+				log.Printf("%s changed but is only applied on restart, keeping %q", s.name, pv)
+			}
+			v, ok = pv, pok
+		}
+		if !ok {
+			continue
+		}
+		if err := s.set(c, v); err != nil {
+			return nil, fmt.Errorf("%s=%q: %w", s.name, v, err)
+		}
+		c.raw[s.name] = v
+	}
+	c.normalizeRegionNames()
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Check settings that only make sense together
+func (c *config) validate() error {
+	// peers are asked over the same kind of http endpoint this region serves
+	if c.BidirectionalCheck && len(c.HttpPort) == 0 && !c.MultiplexPorts {
+		return errors.New("BIDIRECTIONAL_CHECK needs HTTP_PORT or MULTIPLEX_PORTS to ask peers")
+	}
+	// a pipelined connection takes a single reading of each region
+	if c.StableProbes > 1 && c.PipelineTargets > 1 {
+		return errors.New("STABLE_PROBES can't be used with PIPELINE_TARGETS")
+	}
+	return nil
+}
+
+// Bring the regions named in settings to RegionCase, like every other region name, so that
+// PRIMARY_REGION=IAD still matches iad
+func (c *config) normalizeRegionNames() {
+	c.PrimaryRegion = inRegionCase(c.PrimaryRegion, c.RegionCase)
+	targets := make(map[string]sloTarget, len(c.sloTargets))
+	for region, target := range c.sloTargets {
+		targets[inRegionCase(region, c.RegionCase)] = target
+	}
+	c.sloTargets = targets
+}
+
+var activeConfig atomic.Pointer[config]
+
+// the running configuration; the returned value must not be modified
+func conf() *config {
+	return activeConfig.Load()
+}
+
+// The effective value of every setting that isn't a secret, keyed by setting name
+func (c *config) effective() map[string]any {
+	values := make(map[string]any, len(settings))
+	for _, s := range settings {
+		if s.secret {
+			continue
+		}
+		v := s.get(c)
+		if d, ok := v.(time.Duration); ok {
+			v = d.String()
+		}
+		values[s.name] = v
+	}
+	return values
+}
@@ -0,0 +1,205 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The system resolvers, for lookups that need more than the net package exposes
+var resolvConfOnce sync.Once
+var resolvConf *dns.ClientConfig
+var resolvConfErr error
+
+// Send a single query to the system resolvers in turn, returning the first answer. Each
+// resolver gets LatencyRefreshRate to answer, so one that is down can't hold up the refresh.
+func queryDNS(name string, qtype uint16) (*dns.Msg, error) {
+	resolvConfOnce.Do(func() {
+		resolvConf, resolvConfErr = dns.ClientConfigFromFile("/etc/resolv.conf")
+	})
+	if resolvConfErr != nil {
+		return nil, resolvConfErr
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	client := dns.Client{Timeout: conf().LatencyRefreshRate}
+	err := fmt.Errorf("no nameservers configured")
+	for _, server := range resolvConf.Servers {
+		var resp *dns.Msg
+		resp, _, err = client.Exchange(m, net.JoinHostPort(server, resolvConf.Port))
+		if err != nil {
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			return nil, fmt.Errorf("%s lookup of %s: %s", dns.TypeToString[qtype], name, dns.RcodeToString[resp.Rcode])
+		}
+		return resp, nil
+	}
+	return nil, err
+}
+
+var cnameChainLength = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "latency_dns_cname_chain_length",
+		Help: "CNAME records followed to resolve the region's hostname",
+	},
+	[]string{"to"},
+)
+
+var cnameTarget = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "latency_dns_cname_target_info",
+		Help: "Set to 1 for the name the region's hostname finally resolves through",
+	},
+	[]string{"to", "target"},
+)
+
+// the CNAME chain last seen for a region's hostname
+type cnameChain struct {
+	length int
+	target string
+}
+
+// Follow the CNAME records for a region's hostname. Each step of the chain is resolution work
+// on top of the network RTT, so unexpected indirection is logged and exported.
+func inspectCnameChain(r *regionData) {
+	host, _, err := net.SplitHostPort(r.host)
+	if err != nil {
+		host = r.host
+	}
+	// fly's private network is IPv6 only
+	resp, err := queryDNS(host, dns.TypeAAAA)
+	if err != nil {
+		log.Printf("Unable to inspect the CNAME chain of %s: %v", r.region, err)
+		return
+	}
+
+	length, target := 0, dns.Fqdn(host)
+	for _, rr := range resp.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, target) {
+			length++
+			target = cname.Target
+		}
+	}
+	target = strings.TrimSuffix(target, ".")
+
+	if length != r.cnameChain.length || target != r.cnameChain.target {
+		if length > 0 {
+			log.Printf("%s resolves through %d CNAME(s) to %s", host, length, target)
+		}
+		if len(r.cnameChain.target) > 0 {
+			cnameTarget.DeleteLabelValues(r.region, r.cnameChain.target)
+		}
+		r.cnameChain.length, r.cnameChain.target = length, target
+	}
+	cnameChainLength.WithLabelValues(r.region).Set(float64(length))
+	cnameTarget.WithLabelValues(r.region, target).Set(1)
+}
+
+// Inspect the CNAME chain of every region at once, each lookup waiting on the resolver
+func inspectAllCnameChains() {
+	var wg sync.WaitGroup
+	for _, r := range snapshotRegions() {
+		wg.Add(1)
+		go func(r *regionData) {
+			defer wg.Done()
+			inspectCnameChain(r)
+		}(r)
+	}
+	wg.Wait()
+}
+
+var regionsTxtTtl = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "latency_regions_txt_ttl_remaining_seconds",
+		Help: "Remaining TTL of the system resolver's answer for the TXT record listing the deployed regions",
+	},
+)
+
+// Export the TTL of the regions TXT record, which net.LookupTXT doesn't surface. The answer
+// comes from the system resolver, so a cached one carries what is left of the TTL rather than
+// the record's own. Refreshing regions more often than this can't pick up changes any sooner.
+func recordTxtTtl(name string) {
+	resp, err := queryDNS(name, dns.TypeTXT)
+	if err != nil {
+		log.Printf("Unable to look up the TTL of %s: %v", name, err)
+		return
+	}
+	ttl, found := uint32(0), false
+	for _, rr := range resp.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && (!found || txt.Hdr.Ttl < ttl) {
+			ttl, found = txt.Hdr.Ttl, true
+		}
+	}
+	if found {
+		regionsTxtTtl.Set(float64(ttl))
+	}
+}
+
+// Resolved addresses of probe targets, kept for DnsCacheTtl so the resolver isn't asked for
+// every region on every tick
+type cachedAddrs struct {
+	addrs   []string
+	expires time.Time
+}
+
+var dnsCacheMu sync.Mutex
+var dnsCache = make(map[string]cachedAddrs)
+
+var dnsCacheHits = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "latency_dns_cache_hits_total",
+		Help: "Probe target lookups answered from the in-process DNS cache",
+	},
+)
+
+var dnsCacheMisses = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "latency_dns_cache_misses_total",
+		Help: "Probe target lookups that went to the resolver because nothing fresh was cached",
+	},
+)
+
+// Resolve a probe target's hostname, through the cache when it is enabled
+func lookupHostCached(ctx context.Context, host string) ([]string, error) {
+	ttl := conf().DnsCacheTtl
+	if ttl <= 0 {
+		return net.DefaultResolver.LookupHost(ctx, host)
+	}
+	now := time.Now()
+	dnsCacheMu.Lock()
+	cached, ok := dnsCache[host]
+	dnsCacheMu.Unlock()
+	if ok && now.Before(cached.expires) {
+		dnsCacheHits.Inc()
+		return cached.addrs, nil
+	}
+
+	dnsCacheMisses.Inc()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	dnsCacheMu.Lock()
+	dnsCache[host] = cachedAddrs{addrs: addrs, expires: now.Add(ttl)}
+	dnsCacheMu.Unlock()
+	return addrs, nil
+}
+
+// Drop a host from the cache, so the next probe re-resolves it in case its address moved
+func evictHost(host string) {
+	dnsCacheMu.Lock()
+	delete(dnsCache, host)
+	dnsCacheMu.Unlock()
+}
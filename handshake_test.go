@@ -0,0 +1,374 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Start a ping server on a loopback port with the given handshake token, returning its address
+func startHandshakeServer(t *testing.T, token string) string {
+	c := defaultConfig()
+	c.LatencyRefreshRate = 200 * time.Millisecond
+	c.HandshakeToken = token
+	activeConfig.Store(c)
+	currRegion, appName = "iad", "latency-test"
+	if latencyHist == nil {
+		initLatencyMetrics(c)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handlePing(conn.(*net.TCPConn), conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestServerRejectsMissingToken(t *testing.T) {
+	addr := startHandshakeServer(t, "secret")
+	missing := testutil.ToFloat64(rejectedHandshakes.WithLabelValues("missing"))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, announcement("lhr", handshakeVersion))
+
+	// the server gives up on the AUTH line and closes without announcing itself
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read %d bytes and %v from a server waiting for a token, want EOF", n, err)
+	}
+	if got := testutil.ToFloat64(rejectedHandshakes.WithLabelValues("missing")) - missing; got != 1 {
+		t.Errorf("counted %v missing tokens, want 1", got)
+	}
+}
+
+func TestServerWithoutTokenIgnoresAuth(t *testing.T) {
+	addr := startHandshakeServer(t, "")
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, announcement("lhr", handshakeVersion)+authFrame("secret"))
+	io.WriteString(conn, pingFrame(1, "lhr"))
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	scanner := bufio.NewScanner(conn)
+	for _, want := range []string{announcement("iad", handshakeVersion), pongFrame(1, "lhr")} {
+		if !scanner.Scan() {
+			t.Fatalf("no reply, want %q: %v", want, scannerErr(scanner))
+		}
+		if got := scanner.Text() + "\n"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestProbeWithToken(t *testing.T) {
+	addr := startHandshakeServer(t, "secret")
+	r := NewRegion("lhr")
+	tgt := &probeTarget{r: r}
+	probeTargets(addr, []*probeTarget{tgt})
+	if len(tgt.timings.failed) > 0 || r.failures > 0 {
+		t.Errorf("probe with the server's token failed at the %s stage", tgt.timings.failed)
+	}
+}
+
+// A client without a token must give up on a server that waits for one, rather than stalling
+// the probe loop
+func TestProbeWithoutTokenTimesOut(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// read the announcement and keep waiting for an AUTH line that never comes
+		io.Copy(io.Discard, conn)
+	}()
+
+	c := defaultConfig()
+	c.LatencyRefreshRate = 200 * time.Millisecond
+	activeConfig.Store(c)
+	currRegion, appName = "iad", "latency-test"
+	if latencyHist == nil {
+		initLatencyMetrics(c)
+	}
+	r := NewRegion("lhr")
+	tgt := &probeTarget{r: r}
+	done := make(chan struct{})
+	go func() {
+		probeTargets(listener.Addr().String(), []*probeTarget{tgt})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("probe of a server that never announces didn't time out")
+	}
+	if tgt.timings.failed != stageHandshake {
+		t.Errorf("probe failed at the %q stage, want %q", tgt.timings.failed, stageHandshake)
+	}
+}
+
+func TestServerRejectsMalformedAnnouncement(t *testing.T) {
+	addr := startHandshakeServer(t, "")
+	malformed := testutil.ToFloat64(rejectedHandshakes.WithLabelValues("malformed"))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\n")
+
+	// the server announces first, then hangs up on the client
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	scanner := bufio.NewScanner(conn)
+	scanner.Scan()
+	if scanner.Scan() {
+		t.Errorf("server answered %q to a malformed announcement", scanner.Text())
+	} else if err := scanner.Err(); err != nil {
+		t.Fatalf("server didn't close the connection: %v", err)
+	}
+	if got := testutil.ToFloat64(rejectedHandshakes.WithLabelValues("malformed")) - malformed; got != 1 {
+		t.Errorf("counted %v malformed handshakes, want 1", got)
+	}
+}
+
+func TestBinaryHelloEncoding(t *testing.T) {
+	tests := []struct {
+		name  string
+		hello binaryHello
+		want  []byte // nil when encoding should fail
+	}{
+		{
+			name:  "without token",
+			hello: binaryHello{version: binaryVersion, region: "lhr"},
+			want:  []byte{binaryMagic, 4, 3, 'l', 'h', 'r', 0},
+		},
+		{
+			name:  "with token",
+			hello: binaryHello{version: binaryVersion, region: "iad", token: "k1"},
+			want:  []byte{binaryMagic, 4, 3, 'i', 'a', 'd', 2, 'k', '1'},
+		},
+		{
+			name:  "longest fields",
+			hello: binaryHello{version: 255, region: strings.Repeat("a", 63), token: strings.Repeat("t", 255)},
+			want: append(append([]byte{binaryMagic, 255, 63}, strings.Repeat("a", 63)...),
+				append([]byte{255}, strings.Repeat("t", 255)...)...),
+		},
+		{name: "version too large", hello: binaryHello{version: 256, region: "lhr"}},
+		{name: "negative version", hello: binaryHello{version: -1, region: "lhr"}},
+		{name: "region too long", hello: binaryHello{version: binaryVersion, region: strings.Repeat("a", 256)}},
+		{name: "token too long", hello: binaryHello{version: binaryVersion, region: "lhr", token: strings.Repeat("t", 256)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.hello.encode()
+			if tt.want == nil {
+				if err == nil {
+					t.Errorf("encoded %+v as %v, want an error", tt.hello, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("encoding %+v: %v", tt.hello, err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("encoded %+v as %v, want %v", tt.hello, got, tt.want)
+			}
+			decoded, err := readBinaryHello(bufio.NewReader(bytes.NewReader(got)))
+			if err != nil {
+				t.Fatalf("decoding %v: %v", got, err)
+			}
+			if decoded != tt.hello {
+				t.Errorf("decoded %v as %+v, want %+v", got, decoded, tt.hello)
+			}
+		})
+	}
+}
+
+func TestReadBinaryHello(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  []byte
+		want *binaryHello // nil when reading should fail
+	}{
+		{name: "valid", msg: []byte{binaryMagic, 4, 3, 'l', 'h', 'r', 1, 'k'}, want: &binaryHello{4, "lhr", "k"}},
+		{name: "followed by a frame", msg: []byte{binaryMagic, 4, 3, 'l', 'h', 'r', 0, 'P'}, want: &binaryHello{4, "lhr", ""}},
+		{name: "empty", msg: []byte{}},
+		{name: "bad magic", msg: []byte{'L', 'M', '/', '4', ' ', 'l', 'h', 'r', '\n'}},
+		{name: "truncated header", msg: []byte{binaryMagic, 4}},
+		{name: "truncated region", msg: []byte{binaryMagic, 4, 3, 'l', 'h'}},
+		{name: "missing token length", msg: []byte{binaryMagic, 4, 3, 'l', 'h', 'r'}},
+		{name: "truncated token", msg: []byte{binaryMagic, 4, 3, 'l', 'h', 'r', 4, 'k', '1'}},
+		{name: "empty region", msg: []byte{binaryMagic, 4, 0, 0}},
+		{name: "region with a space", msg: []byte{binaryMagic, 4, 3, 'l', ' ', 'r', 0}},
+		{name: "region with a newline", msg: []byte{binaryMagic, 4, 4, 'l', 'h', 'r', '\n', 0}},
+		{name: "region with a leading dash", msg: []byte{binaryMagic, 4, 3, '-', 'h', 'r', 0}},
+		{name: "region with invalid utf-8", msg: []byte{binaryMagic, 4, 3, 'l', 0xff, 'r', 0}},
+		{name: "region longer than a label", msg: append(append([]byte{binaryMagic, 4, 64}, strings.Repeat("a", 64)...), 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rd := bufio.NewReader(bytes.NewReader(tt.msg))
+			got, err := readBinaryHello(rd)
+			if tt.want == nil {
+				if err == nil {
+					t.Errorf("read %+v from %v, want an error", got, tt.msg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("reading %v: %v", tt.msg, err)
+			}
+			if got != *tt.want {
+				t.Errorf("read %+v from %v, want %+v", got, tt.msg, *tt.want)
+			}
+		})
+	}
+}
+
+// Forward connections on a loopback port to addr, delaying everything sent in either
+// direction by delay, so they behave like a path with an RTT of twice that
+func startDelayProxy(t *testing.T, addr string, delay time.Duration) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", addr)
+			if err != nil {
+				client.Close()
+				continue
+			}
+			go delayCopy(server, client, delay)
+			go delayCopy(client, server, delay)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// copy from src to dst, holding each chunk back for delay and closing dst once src is done
+func delayCopy(dst, src net.Conn, delay time.Duration) {
+	type chunk struct {
+		due  time.Time
+		data []byte
+	}
+	chunks := make(chan chunk, 64)
+	go func() {
+		defer dst.Close()
+		for c := range chunks {
+			time.Sleep(time.Until(c.due))
+			if _, err := dst.Write(c.data); err != nil {
+				return
+			}
+		}
+		time.Sleep(delay)
+	}()
+	defer close(chunks)
+	for {
+		buf := make([]byte, 4096)
+		n, err := src.Read(buf)
+		if n > 0 {
+			chunks <- chunk{time.Now().Add(delay), buf[:n]}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func TestPipelinedPingOverLongPath(t *testing.T) {
+	addr := startDelayProxy(t, startHandshakeServer(t, ""), 300*time.Millisecond)
+	c := *conf()
+	c.LatencyRefreshRate = 2 * time.Second
+	activeConfig.Store(&c)
+
+	targets := []*probeTarget{{r: NewRegion("lhr")}, {r: NewRegion("ams")}}
+	if rest := probeTargets(addr, targets); len(rest) > 0 {
+		t.Errorf("%d targets weren't pipelined over a 600ms path", len(rest))
+	}
+	for _, tgt := range targets {
+		if len(tgt.timings.failed) > 0 || tgt.r.failures > 0 {
+			t.Errorf("probe of %s failed at the %s stage", tgt.r.region, tgt.timings.failed)
+		}
+	}
+}
+
+func TestReverseProbeOverLongPath(t *testing.T) {
+	addr := startDelayProxy(t, startHandshakeServer(t, ""), 300*time.Millisecond)
+	c := *conf()
+	c.LatencyRefreshRate = 2 * time.Second
+	c.ReverseProbes = true
+	activeConfig.Store(&c)
+	// the server only records regions it knows, and both ends are currRegion here
+	regionsMu.Lock()
+	regionLatencies[currRegion] = NewRegion(currRegion)
+	regionsMu.Unlock()
+	t.Cleanup(func() {
+		regionsMu.Lock()
+		delete(regionLatencies, currRegion)
+		regionsMu.Unlock()
+	})
+	hist := reverseLatencyHist.WithLabelValues(currRegion, currRegion, string(methodTcpInfo)).(prometheus.Histogram)
+	before := sampleCount(t, hist)
+
+	tgt := &probeTarget{r: NewRegion("lhr")}
+	probeTargets(addr, []*probeTarget{tgt})
+	if len(tgt.timings.failed) > 0 {
+		t.Fatalf("probe failed at the %s stage", tgt.timings.failed)
+	}
+	// the reverse probe runs after the client's own, while it holds the connection
+	deadline := time.Now().Add(5 * time.Second)
+	for sampleCount(t, hist) == before {
+		if time.Now().After(deadline) {
+			t.Fatal("no reverse reading over a 600ms path")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func sampleCount(t *testing.T, h prometheus.Histogram) uint64 {
+	var m dto.Metric
+	if err := h.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
@@ -0,0 +1,132 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var influxDropped = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "latency_influxdb_dropped_total",
+		Help: "Readings discarded because the InfluxDB exporter fell behind or could not write them",
+	},
+)
+
+var influxWriteFailures = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "latency_influxdb_write_failures_total",
+		Help: "Failed attempts to write a batch to InfluxDB",
+	},
+)
+
+var influxRetries = 3
+
+// Export readings to InfluxDB as line protocol. Readings are queued by a reading hook and
+// written in batches by a single goroutine so a slow InfluxDB never holds up probing.
+func startInfluxExporter(c *config) {
+	write := url.Values{}
+	write.Set("bucket", c.InfluxBucket)
+	write.Set("org", c.InfluxOrg)
+	write.Set("precision", "us")
+	endpoint := strings.TrimSuffix(c.InfluxUrl, "/") + "/api/v2/write?" + write.Encode()
+
+	queue := make(chan Reading, 10*c.InfluxBatchSize)
+	addReadingHook(func(rd Reading) {
+		select {
+		case queue <- rd:
+		default:
+			influxDropped.Inc()
+		}
+	})
+	go runInfluxExporter(endpoint, c.InfluxToken, c.InfluxBatchSize, c.InfluxFlushInterval, queue)
+}
+
+func runInfluxExporter(endpoint, token string, batchSize int, flushInterval time.Duration, queue <-chan Reading) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch bytes.Buffer
+	n := 0
+	flush := func() {
+		if n == 0 {
+			return
+		}
+		if err := writeInflux(endpoint, token, batch.Bytes()); err != nil {
+			log.Printf("Dropping %d readings after failing to write them to InfluxDB: %v", n, err)
+			influxDropped.Add(float64(n))
+		}
+		batch.Reset()
+		n = 0
+	}
+
+	for {
+		select {
+		case rd := <-queue:
+			writeInfluxLine(&batch, rd)
+			n++
+			if n >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// escape commas, spaces and equals signs, which delimit tags in line protocol
+var influxTagEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+
+func writeInfluxLine(buf *bytes.Buffer, rd Reading) {
+	fmt.Fprintf(buf, "latency,from=%s,to=%s,method=%s rtt_us=%g %d\n",
+		influxTagEscaper.Replace(rd.From),
+		influxTagEscaper.Replace(rd.To),
+		influxTagEscaper.Replace(string(rd.Method)),
+		rd.Latency,
+		rd.At.UnixMicro())
+}
+
+// post a batch of lines, retrying with backoff
+func writeInflux(endpoint, token string, body []byte) error {
+	var err error
+	for attempt := 0; attempt < influxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		if err = postInflux(endpoint, token, body); err == nil {
+			return nil
+		}
+		influxWriteFailures.Inc()
+	}
+	return err
+}
+
+func postInflux(endpoint, token string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Token "+token)
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
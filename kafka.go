@@ -0,0 +1,96 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+)
+
+var kafkaDropped = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "latency_kafka_dropped_total",
+		Help: "Readings discarded because the Kafka producer fell behind or could not publish them",
+	},
+)
+
+// Readings published per write, and how long a partial batch may wait
+const (
+	kafkaBatchSize     = 100
+	kafkaFlushInterval = time.Second
+)
+
+// The JSON body of a reading published to Kafka
+type kafkaMessage struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Method    string    `json:"method"`
+	LatencyUs float64   `json:"latency_us"`
+	Time      time.Time `json:"time"`
+}
+
+// Publish readings to a Kafka topic as JSON, keyed by "<from>-<to>" so each pair stays in
+// order on one partition. Like the InfluxDB exporter, readings go through a bounded queue
+// and are dropped once it is full, so an unavailable broker never holds up probing.
+func startKafkaExporter(c *config) {
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(strings.Split(c.KafkaBrokers, ",")...),
+		Topic:        c.KafkaTopic,
+		Balancer:     &kafka.Hash{},
+		BatchSize:    kafkaBatchSize,
+		BatchTimeout: 10 * time.Millisecond, // batches are already formed here, don't wait for more
+
+		WriteTimeout: 10 * time.Second,
+	}
+
+	queue := make(chan Reading, 10*kafkaBatchSize)
+	addReadingHook(func(rd Reading) {
+		select {
+		case queue <- rd:
+		default:
+			kafkaDropped.Inc()
+		}
+	})
+	go runKafkaExporter(writer, queue)
+}
+
+func runKafkaExporter(writer *kafka.Writer, queue <-chan Reading) {
+	ticker := time.NewTicker(kafkaFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]kafka.Message, 0, kafkaBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := writer.WriteMessages(context.Background(), batch...); err != nil {
+			log.Printf("Dropping %d readings after failing to publish them to Kafka: %v", len(batch), err)
+			kafkaDropped.Add(float64(len(batch)))
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case rd := <-queue:
+			value, err := json.Marshal(kafkaMessage{rd.From, rd.To, string(rd.Method), rd.Latency, rd.At.UTC()})
+			if err != nil {
+				kafkaDropped.Inc()
+				continue
+			}
+			batch = append(batch, kafka.Message{Key: []byte(rd.From + "-" + rd.To), Value: value})
+			if len(batch) >= kafkaBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
@@ -3,14 +3,18 @@
 package main
 
 import (
-	"bufio"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
-	"io"
 	"log"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -23,10 +27,19 @@ import (
 // Get the RTT from the OS itself rather than timing it ourselves
 // NB: Only works on linux
 func tcpOsRtt(conn *net.TCPConn) (int, error) {
-	raw, err := conn.SyscallConn()
+	info, err := tcpOsInfo(conn)
 	if err != nil {
 		return 0, err
 	}
+	return int(info.Rtt), nil
+}
+
+// Get everything the kernel knows about the connection
+func tcpOsInfo(conn *net.TCPConn) (*unix.TCPInfo, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
 
 	var info *unix.TCPInfo
 	ctrlErr := raw.Control(func(fd uintptr) {
@@ -34,73 +47,330 @@ func tcpOsRtt(conn *net.TCPConn) (int, error) {
 	})
 	switch {
 	case ctrlErr != nil:
-		return 0, ctrlErr
+		return nil, ctrlErr
 	case err != nil:
-		return 0, err
+		return nil, err
 	}
-	return int(info.Rtt), nil
+	return info, nil
 }
 
 func recordLatencies(ticker *time.Ticker) {
 	for range ticker.C {
-		for _, r := range regionLatencies {
-			// connect over TCP to all the servers
-			conn, err := net.Dial("tcp", r.host)
-			if err != nil {
-				log.Printf("Unable to connect to %s: %v", r.region, err)
-				continue
-			}
+		if probingPaused.Load() {
+			continue
+		}
+		probeAllRegions()
+	}
+}
 
-			// tell the server your source region
-			fmt.Fprintf(conn, currRegion+"\n")
+// probe every region that is due, or a random sample of them when ProbeSampleSize is set
+func probeAllRegions() {
+	now := time.Now()
+	defer func() { probeCycleDuration.Observe(float64(time.Since(now).Microseconds())) }()
+	regions := dueRegions(now)
+	if k := conf().ProbeSampleSize; k > 0 && k < len(regions) {
+		rand.Shuffle(len(regions), func(i, j int) { regions[i], regions[j] = regions[j], regions[i] })
+		regions = regions[:k]
+	}
+	for _, r := range regions {
+		r.schedule(now)
+	}
+	defer forgetRemoved(regions)
+	if n := conf().PipelineTargets; n > 1 {
+		probePipelined(regions, n)
+		return
+	}
+	for _, r := range regions {
+		if !r.isRemoved() {
+			probeRegion(r)
+		}
+	}
+}
 
-			// read the server's region
-			scanner := bufio.NewScanner(conn)
-			scanner.Scan()
-			serverRegion := scanner.Text()
+// A cycle approaching LatencyRefreshRate means the prober can't keep up with the regions
+var probeCycleDuration = promauto.NewHistogram(
+	prometheus.HistogramOpts{
+		Name:    "latency_probe_cycle_duration_microseconds",
+		Help:    "Wall clock time of each full probe cycle in microseconds",
+		Buckets: prometheus.ExponentialBuckets(1000, 2, 16),
+	},
+)
 
-			// get the RTT
-			latency, err := tcpOsRtt(conn.(*net.TCPConn))
-			conn.Close()
-			if err != nil {
-				log.Printf("Unable to extract rtt from tcp conn on client to %s: %v", r.region, err)
-				continue
-			}
+// How often each region is probed on average once sampling is taken into account
+var effectiveProbeInterval = promauto.NewGaugeFunc(
+	prometheus.GaugeOpts{
+		Name: "latency_effective_probe_interval_seconds",
+		Help: "Average seconds between probes of any one region",
+	},
+	func() float64 {
+		regionsMu.RLock()
+		n := len(regionLatencies)
+		regionsMu.RUnlock()
+		c := conf()
+		if c.ProbeSampleSize <= 0 || c.ProbeSampleSize >= n {
+			return c.LatencyRefreshRate.Seconds()
+		}
+		return c.LatencyRefreshRate.Seconds() * float64(n) / float64(c.ProbeSampleSize)
+	},
+)
 
-			// update the prometheus metrics
-			r.hist.Observe(float64(latency))
-			r.last = latency
+// A way of taking a latency reading. Only the constants below are valid so the method
+// label stays bounded.
+type probeMethod string
 
-			log.Printf("C:\t%s\t%s\t%d", currRegion, serverRegion, latency)
-		}
+const (
+	methodTcpInfo   probeMethod = "tcp_info"  // the kernel's smoothed RTT from TCP_INFO
+	methodHandshake probeMethod = "handshake" // time from connecting until the server's region line arrives
+)
+
+// Far above 1 means time is being lost in the application or socket layer (scheduling, a busy
+// peer) rather than on the network
+var appToKernelRatio = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "latency_app_to_kernel_ratio",
+		Help: "Handshake RTT divided by the kernel's TCP_INFO RTT for the latest probe",
+	},
+	[]string{"to"},
+)
+
+// All client side latency observations, labelled by source and destination region and
+// by the method that produced them. Created by initLatencyMetrics once the config is loaded.
+var latencyHist *prometheus.HistogramVec
+
+func initLatencyMetrics(c *config) {
+	// labels describing the probing end, on the histograms of readings this process takes
+	source := prometheus.Labels{}
+	if c.ProbeDscp > 0 {
+		// readings for one traffic class aren't comparable with another's, so keep them apart
+		source["dscp"] = strconv.Itoa(c.ProbeDscp)
 	}
+	if len(c.SourceZone) > 0 {
+		source["from_zone"] = c.SourceZone
+	}
+	opts := latencyHistogramOpts(c, "latency_rtt_microseconds", "Round trip time between regions in microseconds")
+	primaryOpts := primaryHistogramOpts()
+	reverseOpts := latencyHistogramOpts(c, "latency_reverse_rtt_microseconds", "Round trip time this server measured by probing a connected client in microseconds")
+	if len(source) > 0 {
+		opts.ConstLabels, primaryOpts.ConstLabels, reverseOpts.ConstLabels = source, source, source
+	}
+	latencyHist = promauto.NewHistogramVec(opts, []string{"from", "to", "method"})
+	primaryLatencyHist = promauto.NewHistogramVec(primaryOpts, []string{"from", "to"})
+	serverLatencyHist = promauto.NewHistogramVec(
+		latencyHistogramOpts(c, "latency_server_rtt_microseconds", "TCP_INFO round trip time seen by this server on connections from the client region"),
+		[]string{"from", "to"},
+	)
+	reverseLatencyHist = promauto.NewHistogramVec(reverseOpts, []string{"from", "to", "method"})
+	initTcpInfoMetrics(c)
 }
 
+// Bucket layout shared by the latency histograms. Every region and method gets its own series,
+// so memory grows with regions × methods × buckets; the bucket settings are the knob that
+// bounds it.
+func latencyHistogramOpts(c *config, name, help string) prometheus.HistogramOpts {
+	opts := prometheus.HistogramOpts{
+		Name: name,
+		Help: help,
+	}
+	if c.HistogramBuckets > 0 {
+		// doubling from 100µs covers anything from a rack neighbour to the other side of the world
+		opts.Buckets = prometheus.ExponentialBuckets(100, 2, c.HistogramBuckets)
+	}
+	if c.NativeHistogramBucketFactor > 1 {
+		opts.NativeHistogramBucketFactor = c.NativeHistogramBucketFactor
+		opts.NativeHistogramMaxBucketNumber = uint32(c.NativeHistogramMaxBuckets)
+		opts.NativeHistogramMinResetDuration = time.Hour
+	}
+	return opts
+}
+
+// The most recent TCP_INFO reading per region, for dashboards that want a single current value
+var lastLatency = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "latency_last_rtt_microseconds",
+		Help: "Most recent TCP_INFO round trip time, NaN while the region is unreachable",
+	},
+	[]string{"from", "to"},
+)
+
+// The steps of a probe, used to tell whether failures are in the network (connect) or in the
+// peer (handshake)
+const (
+	stageDns       = "dns"
+	stageConnect   = "connect"
+	stageHandshake = "handshake"
+	stageRtt       = "rtt"
+)
+
+var probeFailures = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "latency_probe_failures_total",
+		Help: "Probes that failed to produce a latency reading, by the step that failed",
+	},
+	[]string{"to", "stage"},
+)
+
+var invalidReadings = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "latency_invalid_readings_total",
+		Help: "TCP_INFO readings discarded for being below the configured floor",
+	},
+	[]string{"to"},
+)
+
+var connectSuccesses = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "latency_connect_success_total",
+		Help: "Probes that established a TCP connection",
+	},
+	[]string{"to"},
+)
+
+var handshakeSuccesses = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "latency_handshake_success_total",
+		Help: "Probes that completed the region handshake",
+	},
+	[]string{"to"},
+)
+
 type regionData struct {
-	hist   prometheus.Histogram
-	last   int    // the last latency reading
-	region string // the shortened region name to which this a client connected
-	host   string // hostname for connecting to region
+	hist       prometheus.ObserverVec // latencyHist curried with this region, by method
+	legacyHist prometheus.Histogram   // per-name histogram kept for old dashboards, nil unless LegacyMetricNames
+	last       float64                // the last latency reading, NaN before the first and once collapsed as unreachable
+	stable     float64                // the last reading taken with a quorum of recent probes succeeding
+	lastUpdate time.Time              // when last was recorded, or when the region was discovered
+	failures   int                    // consecutive failed probes
+	discovered time.Time              // when updateRegions first saw the region
+	cnameChain cnameChain             // only touched by updateRegions
+	samples    *sampleRing            // recent probe outcomes for the windowed statistics
+	nextProbe  time.Time              // when the region is next due a probe, only touched by the prober
+	offPath    int                    // consecutive readings away from the median, only touched by the prober
+	addr       string                 // IP the host last resolved to, only touched by the prober
+	srv        *srvTarget             // set for external targets found through SRV records, nil for regions
+	static     bool                   // added through /targets rather than discovered
+	removed    bool                   // no longer in regionLatencies, so done with
+	// handshake version the server last announced, -1 before the first handshake; only
+	// touched by the probing goroutine
+	peerVersion int
+	region      string // the shortened region name to which this a client connected
+	host        string // hostname for connecting to region
 }
 
 func NewRegion(r string) *regionData {
-	return &regionData{
-		hist: promauto.NewHistogram(
-			prometheus.HistogramOpts{
-				Name: fmt.Sprintf("latency_%s_to_%s_microsecond", currRegion, r),
-			}),
-		region: r,
-		host:   fmt.Sprintf("%s.%s.internal:%s", r, appName, tcpPort),
+	now := time.Now()
+	rd := &regionData{
+		hist:        latencyHist.MustCurryWith(prometheus.Labels{"from": currRegion, "to": r}),
+		discovered:  now,
+		lastUpdate:  now,
+		peerVersion: -1,
+		last:        math.NaN(),
+		stable:      math.NaN(),
+		samples:     newSampleRing(statsRingCapacity(conf())),
+		region:      r,
+		host:        fmt.Sprintf("%s.%s.internal:%s", r, appName, conf().TcpPort),
 	}
+	if conf().LegacyMetricNames {
+		rd.legacyHist = registerLegacyHist(r)
+	}
+	return rd
+}
+
+func (r *regionData) recordSuccess(latency int) {
+	now := time.Now()
+	regionsMu.Lock()
+	r.last = float64(latency)
+	r.lastUpdate = now
+	r.failures = 0
+	r.samples.add(sample{at: now, latency: float64(latency)})
+	r.updateStable()
+	regionsMu.Unlock()
+	lastLatency.WithLabelValues(currRegion, r.region).Set(float64(latency))
 }
 
+// count a failed probe, clearing the last reading once the region has been failing for
+// long enough that showing it would be misleading
+func (r *regionData) recordFailure(stage string) {
+	if warmingUp() {
+		return
+	}
+	// a newly deployed region's ping server may still be starting
+	if grace := conf().DiscoveryGrace; time.Since(r.discovered) < grace {
+		log.Printf("%s was discovered less than %s ago, not counting the failure", r.region, grace)
+		return
+	}
+	probeFailures.WithLabelValues(r.region, stage).Inc()
+	regionsMu.Lock()
+	defer regionsMu.Unlock()
+	r.failures++
+	r.samples.add(sample{at: time.Now(), latency: math.NaN()})
+	if n := conf().CollapseAfterFailures; n > 0 && r.failures >= n && !math.IsNaN(r.last) {
+		log.Printf("%s has failed %d consecutive probes, clearing its last reading", r.region, r.failures)
+		r.last = math.NaN()
+		lastLatency.WithLabelValues(currRegion, r.region).Set(math.NaN())
+	}
+	r.updateStable()
+}
+
+// record a latency reading, mirroring TCP_INFO readings into the legacy histogram during the
+// migration period
+func (r *regionData) observe(method probeMethod, latency float64) {
+	r.hist.WithLabelValues(string(method)).Observe(latency)
+	if r.legacyHist != nil && method == methodTcpInfo {
+		r.legacyHist.Observe(latency)
+	}
+	if method == methodTcpInfo && r.involvesPrimary() {
+		primaryLatencyHist.WithLabelValues(currRegion, r.region).Observe(latency)
+	}
+	emitReading(Reading{From: currRegion, To: r.region, Method: method, Latency: latency, At: time.Now()})
+}
+
+// regionsMu guards regionLatencies as well as the mutable fields of its entries
+var regionsMu sync.RWMutex
 var regionLatencies = make(map[string]*regionData)
 
+// snapshotRegions returns the known regions so callers can iterate without holding the lock
+func snapshotRegions() []*regionData {
+	regionsMu.RLock()
+	defer regionsMu.RUnlock()
+	regions := make([]*regionData, 0, len(regionLatencies))
+	for _, r := range regionLatencies {
+		regions = append(regions, r)
+	}
+	return regions
+}
+
+// The age of the stalest reading across all regions; if this grows unbounded some region
+// has stopped being measured
+var oldestReadingAge = promauto.NewGaugeFunc(
+	prometheus.GaugeOpts{
+		Name: "latency_oldest_reading_age_seconds",
+		Help: "Seconds since the least recently updated region reading",
+	},
+	func() float64 {
+		regionsMu.RLock()
+		defer regionsMu.RUnlock()
+		var oldest time.Duration
+		for _, r := range regionLatencies {
+			if age := time.Since(r.lastUpdate); age > oldest {
+				oldest = age
+			}
+		}
+		return oldest.Seconds()
+	},
+)
+
 // TXT records contain all the deployed regions
 // At some interval, refresh the information and create new regions if they don't exist
 func updateRegions(ticker *time.Ticker) {
 	for range ticker.C {
-		entries, err := net.LookupTXT(fmt.Sprintf("regions.%s.internal", appName))
+		var services []string
+		if c := conf(); len(c.SrvServices) > 0 {
+			services = strings.Split(c.SrvServices, ",")
+		}
+		updateSrvTargets(services, conf().SrvAllPriorities)
+
+		name := fmt.Sprintf("regions.%s.internal", appName)
+		entries, err := net.LookupTXT(name)
 		if err != nil {
 			log.Printf("TXT lookup for all deployed regions failed: %v", err)
 		}
@@ -111,73 +381,59 @@ func updateRegions(ticker *time.Ticker) {
 		if len(entries) > 1 {
 			log.Printf("Multiple TXT records, using first")
 		}
-		entries = strings.Split(entries[0], ",")
 		// TODO: Drop old regions from the map?
-		for _, r := range entries {
-			if _, ok := regionLatencies[r]; !ok {
-				regionLatencies[r] = NewRegion(r)
-			}
+		addRegions(strings.Split(entries[0], ","))
+		recordTxtTtl(name)
+
+		if conf().DnsChainMetrics {
+			inspectAllCnameChains()
+		}
+		if conf().BidirectionalCheck {
+			checkAllBidirectional()
 		}
 	}
 }
 
-// simple HTTP method to get all the latencies to all other regions in the given region
-func getLatencies(w http.ResponseWriter, r *http.Request) {
-	for _, r := range regionLatencies {
-		io.WriteString(w, fmt.Sprintf("%s\t%s\t%d\n", currRegion, r.region, r.last))
+// Check the request carries ConfigAuthToken, if one is set, answering it with 401 if not
+func authorized(w http.ResponseWriter, r *http.Request) bool {
+	want := conf().ConfigAuthToken
+	if len(want) == 0 {
+		return true
 	}
-}
-
-// listen for clients (peers) on TCP so they can measure latency to you
-func runTcpPingServer() {
-	listener, err := net.Listen("tcp", ":"+tcpPort)
-	if err != nil {
-		log.Fatal(err)
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
 	}
+	return true
+}
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Printf("Failed to accept a client connection: %v", err)
-		}
-		go func(c *net.TCPConn) {
-			defer c.Close()
-			// send your region to the client
-			fmt.Fprintf(c, currRegion+"\n")
-
-			// read the client's region
-			scanner := bufio.NewScanner(c)
-			scanner.Scan()
-			clientRegion := scanner.Text()
-
-			// record what the server's perceived latency is
-			latency, err := tcpOsRtt(c)
-			if err != nil {
-				log.Printf("Unable to extract rtt from tcp conn on server: %v", err)
-				return
-			}
-
-			log.Printf("S:\t%s\t%s\t%d", currRegion, clientRegion, latency)
-			//hold the conn open for the client so everything can close cleanly
-			time.Sleep(250 * time.Millisecond)
-
-		}(conn.(*net.TCPConn))
+// the fully resolved configuration as JSON, for checking what the process is actually running with
+func getConfig(w http.ResponseWriter, r *http.Request) {
+	c := conf()
+	if !authorized(w, r) {
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		appNameEnvVar:    appName,
+		currRegionEnvVar: currRegion,
+		"settings":       c.effective(),
+	})
 }
 
 var appNameEnvVar = "FLY_APP_NAME"
 var appName = ""
 var currRegionEnvVar = "FLY_REGION"
 var currRegion = ""
-var regionRefreshRate = 10 * time.Second
-var latencyRefreshRate = 1 * time.Second
-var tcpPort = "10000"
-var httpPort = "9091"
 
 func main() {
 
 	var ok bool
 
+	// go.mod predates automatic seeding, so sampling would repeat the same order on every start
+	rand.Seed(time.Now().UnixNano())
+
 	currRegion, ok = os.LookupEnv(currRegionEnvVar)
 	if !ok || len(currRegion) == 0 {
 		log.Fatal(fmt.Sprintf("%s is unset", currRegionEnvVar))
@@ -186,22 +442,74 @@ func main() {
 	if !ok || len(currRegion) == 0 {
 		log.Fatal(fmt.Sprintf("%s is unset", appNameEnvVar))
 	}
+	c, err := loadConfig(nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	activeConfig.Store(c)
+	currRegion = normalizeRegion(currRegion, "local")
+	initLatencyMetrics(c)
 
-	regionRefreshTicker := time.NewTicker(regionRefreshRate)
+	if len(c.InfluxUrl) > 0 {
+		startInfluxExporter(c)
+	}
+	if len(c.OtlpEndpoint) > 0 {
+		startOtlpExporter(c)
+	}
+	if len(c.KafkaBrokers) > 0 {
+		startKafkaExporter(c)
+	}
+
+	if len(c.TargetsFile) > 0 {
+		if err := loadStaticTargets(c.TargetsFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	regionRefreshTicker := time.NewTicker(c.RegionRefreshRate)
 	defer regionRefreshTicker.Stop()
 	go updateRegions(regionRefreshTicker)
 
-	updateLatencyTicker := time.NewTicker(latencyRefreshRate)
+	updateLatencyTicker := time.NewTicker(c.LatencyRefreshRate)
 	defer updateLatencyTicker.Stop()
 	go recordLatencies(updateLatencyTicker)
 
-	go runTcpPingServer()
+	go handleSignals(regionRefreshTicker, updateLatencyTicker)
+
+	if c.StdoutReportInterval > 0 {
+		reportTicker := time.NewTicker(c.StdoutReportInterval)
+		defer reportTicker.Stop()
+		go reportToStdout(reportTicker)
+	}
+	if len(c.TextfilePath) > 0 {
+		textfileTicker := time.NewTicker(c.TextfileInterval)
+		defer textfileTicker.Stop()
+		go writeTextfile(c.TextfilePath, textfileTicker)
+	}
 
 	http.Handle("/metrics", promhttp.Handler())
 	http.HandleFunc("/", getLatencies)
+	http.HandleFunc("/config", getConfig)
+	http.HandleFunc("/targets", handleTargets)
+	http.HandleFunc("/annotate", postAnnotation)
+	http.HandleFunc("/pause", setProbingPaused(true))
+	http.HandleFunc("/resume", setProbingPaused(false))
+	http.HandleFunc("/ready", getReady)
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(currRegion))
 	})
-	log.Fatal(http.ListenAndServe(":"+httpPort, nil))
+
+	if c.MultiplexPorts {
+		httpConns := newConnQueue()
+		go runTcpPingServer(httpConns)
+		log.Fatal(http.Serve(httpConns, nil))
+	}
+	if len(c.HttpPort) == 0 {
+		// the metrics only leave through the textfile or the exporters
+		runTcpPingServer(nil)
+		return
+	}
+	go runTcpPingServer(nil)
+	log.Fatal(http.ListenAndServe(":"+c.HttpPort, nil))
 
 }
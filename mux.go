@@ -0,0 +1,83 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+// The first four bytes of every request method the http server handles. A ping client always
+// speaks first with its announcement, and neither "LM/<version>" nor a region name followed
+// by a newline can start like this.
+var httpPrefixes = map[string]bool{
+	"GET ": true, "HEAD": true, "POST": true, "PUT ": true, "DELE": true,
+	"OPTI": true, "PATC": true, "CONN": true, "TRAC": true,
+}
+
+// how long a client gets to send its first bytes before the connection is dropped
+var sniffTimeout = 10 * time.Second
+
+// peek at the first bytes a client sends to tell an http request from a ping handshake
+func sniffHttp(c net.Conn, rd *bufio.Reader) (bool, error) {
+	c.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer c.SetReadDeadline(time.Time{})
+	prefix, err := rd.Peek(4)
+	if err != nil {
+		return false, err
+	}
+	return httpPrefixes[string(prefix)], nil
+}
+
+// a connection whose first bytes have already been read into a buffer
+type peekedConn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.rd.Read(p)
+}
+
+// connQueue is a net.Listener fed with connections accepted elsewhere, letting the http server
+// serve connections picked out by the ping server
+type connQueue struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnQueue() *connQueue {
+	return &connQueue{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (q *connQueue) push(c net.Conn) {
+	select {
+	case q.conns <- c:
+	case <-q.done:
+		c.Close()
+	}
+}
+
+func (q *connQueue) Accept() (net.Conn, error) {
+	select {
+	case c := <-q.conns:
+		return c, nil
+	case <-q.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (q *connQueue) Close() error {
+	q.closeOnce.Do(func() { close(q.done) })
+	return nil
+}
+
+func (q *connQueue) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
@@ -0,0 +1,100 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// The formats / can answer in
+const (
+	formatTsv        = "tsv"
+	formatJson       = "json"
+	formatPrometheus = "prometheus"
+)
+
+// Pick the format for an Accept header, preferring the highest quality and then the earliest
+// listed. text/plain asks for the original tab separated output, unless it carries a version
+// parameter the way prometheus scrapers send it.
+func negotiateFormat(accept string) string {
+	best, bestQ := formatTsv, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		var format string
+		switch mediaType {
+		case "application/json":
+			format = formatJson
+		case "text/plain":
+			format = formatTsv
+			if _, ok := params["version"]; ok {
+				format = formatPrometheus
+			}
+		case "text/*", "*/*":
+			format = formatTsv
+		default:
+			continue
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
+// get all the latencies to all other regions in the given region, in whichever format the
+// client accepts
+func getLatencies(w http.ResponseWriter, r *http.Request) {
+	switch negotiateFormat(r.Header.Get("Accept")) {
+	case formatJson:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newLatencyReport())
+	case formatPrometheus:
+		writeLastLatencies(w)
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		regionsMu.RLock()
+		defer regionsMu.RUnlock()
+		for _, r := range regionLatencies {
+			last, stale := r.displayed()
+			if stale {
+				io.WriteString(w, fmt.Sprintf("%s\t%s\t%.0f\tstale\n", currRegion, r.region, last))
+				continue
+			}
+			io.WriteString(w, fmt.Sprintf("%s\t%s\t%.0f\n", currRegion, r.region, last))
+		}
+	}
+}
+
+// the latest reading per region as latency_last_rtt_microseconds, in the prometheus text format
+func writeLastLatencies(w http.ResponseWriter) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		log.Printf("Unable to gather metrics for /: %v", err)
+	}
+	w.Header().Set("Content-Type", string(expfmt.FmtText))
+	enc := expfmt.NewEncoder(w, expfmt.FmtText)
+	for _, mf := range families {
+		if mf.GetName() == "latency_last_rtt_microseconds" {
+			enc.Encode(mf)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+//go:build linux
+
+package main
+
+import "testing"
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{accept: "", want: formatTsv},
+		{accept: "application/json", want: formatJson},
+		{accept: "text/plain", want: formatTsv},
+		{accept: "text/plain; charset=utf-8", want: formatTsv},
+		{accept: "text/plain; version=0.0.4", want: formatPrometheus},
+		{accept: "application/openmetrics-text; version=1.0.0,text/plain;version=0.0.4;q=0.5,*/*;q=0.1", want: formatPrometheus},
+		{accept: "*/*", want: formatTsv},
+		{accept: "text/*", want: formatTsv},
+		{accept: "application/json, */*", want: formatJson},
+		{accept: "*/*, application/json", want: formatTsv},
+		{accept: "*/*;q=0.8, application/json", want: formatJson},
+		{accept: "application/json;q=0.5, text/plain", want: formatTsv},
+		{accept: "text/plain;q=0.2, application/json;q=0.9", want: formatJson},
+		{accept: "application/json;q=0.9, text/plain;q=0.9", want: formatJson},
+		{accept: "application/json;q=0", want: formatTsv},
+		{accept: "text/html, application/xml", want: formatTsv},
+		{accept: "text/html, application/json;q=0.1", want: formatJson},
+		{accept: "application/json;q=high, text/plain;version=0.0.4", want: formatPrometheus},
+		{accept: "not a media type, application/json", want: formatJson},
+		{accept: "APPLICATION/JSON", want: formatJson},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			if got := negotiateFormat(tt.accept); got != tt.want {
+				t.Errorf("negotiateFormat(%q) = %s, want %s", tt.accept, got, tt.want)
+			}
+		})
+	}
+}
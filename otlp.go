@@ -0,0 +1,202 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// AggregationTemporality values from the OTLP metrics protocol
+const (
+	otlpTemporalityDelta      = 1
+	otlpTemporalityCumulative = 2
+)
+
+// Exponential histogram scale; at 3 each power of two is split into 8 buckets, about 9% wide
+const otlpScale = 3
+
+var otlpExportFailures = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "latency_otlp_export_failures_total",
+		Help: "Failed exports to the OTLP endpoint",
+	},
+)
+
+// the exponential histogram of one from/to/method series
+type otlpPoint struct {
+	from, to, method string
+	start            time.Time
+	count            uint64
+	sum              float64
+	min, max         float64
+	zeroCount        uint64
+	buckets          map[int]uint64 // by bucket index at otlpScale
+}
+
+func (p *otlpPoint) observe(v float64) {
+	if p.count == 0 || v < p.min {
+		p.min = v
+	}
+	if p.count == 0 || v > p.max {
+		p.max = v
+	}
+	p.count++
+	p.sum += v
+	if v <= 0 {
+		p.zeroCount++
+		return
+	}
+	// bucket i holds (base^i, base^(i+1)] where base = 2^(2^-scale)
+	p.buckets[int(math.Ceil(math.Log2(v)*math.Ldexp(1, otlpScale)))-1]++
+}
+
+// otlpAggregator accumulates readings between exports
+type otlpAggregator struct {
+	mu          sync.Mutex
+	points      map[[3]string]*otlpPoint
+	temporality int
+}
+
+func (a *otlpAggregator) observe(rd Reading) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := [3]string{rd.From, rd.To, string(rd.Method)}
+	p, ok := a.points[key]
+	if !ok {
+		p = &otlpPoint{from: rd.From, to: rd.To, method: string(rd.Method), start: rd.At, buckets: make(map[int]uint64)}
+		a.points[key] = p
+	}
+	p.observe(rd.Latency)
+}
+
+// Build the export request for everything observed so far, or nil if there is nothing to export.
+// With delta temporality each export only covers what was observed since the previous one, so
+// the points are reset afterwards.
+func (a *otlpAggregator) collect(now time.Time) map[string]any {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	dataPoints := make([]map[string]any, 0, len(a.points))
+	for key, p := range a.points {
+		if p.count == 0 {
+			continue
+		}
+		dataPoints = append(dataPoints, p.toOtlp(now))
+		if a.temporality == otlpTemporalityDelta {
+			a.points[key] = &otlpPoint{from: p.from, to: p.to, method: p.method, start: now, buckets: make(map[int]uint64)}
+		}
+	}
+	if len(dataPoints) == 0 {
+		return nil
+	}
+	return map[string]any{
+		"resourceMetrics": []any{map[string]any{
+			"resource": map[string]any{"attributes": []any{otlpAttribute("service.name", "latency-metrics")}},
+			"scopeMetrics": []any{map[string]any{
+				"scope": map[string]any{"name": "latency-metrics"},
+				"metrics": []any{map[string]any{
+					"name":        "latency.rtt",
+					"description": "Round trip time between regions",
+					"unit":        "us",
+					"exponentialHistogram": map[string]any{
+						"aggregationTemporality": a.temporality,
+						"dataPoints":             dataPoints,
+					},
+				}},
+			}},
+		}},
+	}
+}
+
+// OTLP/JSON encodes 64 bit integers as strings
+func (p *otlpPoint) toOtlp(now time.Time) map[string]any {
+	lowest, highest := math.MaxInt, math.MinInt
+	for i := range p.buckets {
+		if i < lowest {
+			lowest = i
+		}
+		if i > highest {
+			highest = i
+		}
+	}
+	counts := []string{}
+	for i := lowest; i <= highest; i++ {
+		counts = append(counts, strconv.FormatUint(p.buckets[i], 10))
+	}
+	positive := map[string]any{"bucketCounts": counts}
+	if len(p.buckets) > 0 {
+		positive["offset"] = lowest
+	}
+	return map[string]any{
+		"attributes": []any{
+			otlpAttribute("from", p.from),
+			otlpAttribute("to", p.to),
+			otlpAttribute("method", p.method),
+		},
+		"startTimeUnixNano": strconv.FormatInt(p.start.UnixNano(), 10),
+		"timeUnixNano":      strconv.FormatInt(now.UnixNano(), 10),
+		"count":             strconv.FormatUint(p.count, 10),
+		"sum":               p.sum,
+		"min":               p.min,
+		"max":               p.max,
+		"scale":             otlpScale,
+		"zeroCount":         strconv.FormatUint(p.zeroCount, 10),
+		"positive":          positive,
+	}
+}
+
+func otlpAttribute(key, value string) map[string]any {
+	return map[string]any{"key": key, "value": map[string]any{"stringValue": value}}
+}
+
+// Export readings as OTLP exponential histograms over HTTP/JSON. Some backends only ingest
+// delta temporality, so the temporality is configurable.
+func startOtlpExporter(c *config) {
+	agg := &otlpAggregator{points: make(map[[3]string]*otlpPoint), temporality: otlpTemporalityCumulative}
+	if c.OtlpTemporality == "delta" {
+		agg.temporality = otlpTemporalityDelta
+	}
+	addReadingHook(agg.observe)
+
+	go func() {
+		ticker := time.NewTicker(c.OtlpExportInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			request := agg.collect(now)
+			if request == nil {
+				continue
+			}
+			if err := exportOtlp(c.OtlpEndpoint, request); err != nil {
+				log.Printf("OTLP export failed: %v", err)
+				otlpExportFailures.Inc()
+			}
+		}
+	}()
+}
+
+func exportOtlp(endpoint string, request map[string]any) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
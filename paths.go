@@ -0,0 +1,79 @@
+//go:build linux
+
+package main
+
+import (
+	"log"
+	"math"
+	"net"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Consecutive readings away from the window's median before they count as a new path rather
+// than noise
+const pathChangeConfirmations = 3
+
+var pathChanges = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "latency_path_changes_total",
+		Help: "Shifts of the region's RTT to a different level, as when probes move to another path",
+	},
+	[]string{"to"},
+)
+
+// Watch for readings settling on a different level than the region's recent median. On an
+// ECMP network, probes that hash onto different paths give a bimodal distribution, so each
+// move between the modes is counted.
+func (r *regionData) detectPathChange(latency int) {
+	threshold := conf().PathChangeThreshold
+	if threshold <= 0 {
+		return
+	}
+	median := r.windowStats().quantile(0.5)
+	if math.IsNaN(median) || median <= 0 {
+		return
+	}
+	if math.Abs(float64(latency)-median)/median <= threshold {
+		r.offPath = 0
+		return
+	}
+	r.offPath++
+	if r.offPath == pathChangeConfirmations {
+		log.Printf("RTT to %s moved from around %.0fµs to %dµs, the path may have changed", r.region, median, latency)
+		pathChanges.WithLabelValues(r.region).Inc()
+	}
+}
+
+var ipChanges = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "latency_target_ip_changes_total",
+		Help: "Times the region's hostname resolved to a different address than the probe before",
+	},
+	[]string{"to"},
+)
+
+// Note the address a region's hostname resolved to. A new address is likely a different
+// machine or path, so a step change in latency that follows it has an explanation. Unless
+// configured otherwise the windowed statistics carry on across the change; resetting them
+// keeps the old address's readings from skewing the window.
+func (r *regionData) recordAddress(addr string) {
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	prev := r.addr
+	r.addr = ip
+	if len(prev) == 0 || prev == ip {
+		return
+	}
+	log.Printf("%s now resolves to %s, was %s", r.region, ip, prev)
+	ipChanges.WithLabelValues(r.region).Inc()
+	if conf().IpChangeResetsWindow {
+		regionsMu.Lock()
+		r.samples = newSampleRing(len(r.samples.buf))
+		regionsMu.Unlock()
+		r.offPath = 0
+	}
+}
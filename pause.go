@@ -0,0 +1,51 @@
+//go:build linux
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Set while an operator has halted probing. Ticks are skipped rather than probing and
+// failing, so a pause doesn't show up as failures or collapse any region.
+var probingPaused atomic.Bool
+
+var probingPausedGauge = promauto.NewGaugeFunc(
+	prometheus.GaugeOpts{
+		Name: "latency_probing_paused",
+		Help: "1 while probing is paused through /pause",
+	},
+	func() float64 {
+		if probingPaused.Load() {
+			return 1
+		}
+		return 0
+	},
+)
+
+// handler for POST /pause and /resume, setting the paused state to paused
+func setProbingPaused(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorized(w, r) {
+			return
+		}
+		if probingPaused.Swap(paused) != paused {
+			if paused {
+				log.Printf("Probing paused by %s", r.RemoteAddr)
+			} else {
+				log.Printf("Probing resumed by %s", r.RemoteAddr)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,398 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Where the time went in a single probe, for the verbose probe log
+type probeTimings struct {
+	addr      string
+	dns       time.Duration
+	connect   time.Duration
+	handshake time.Duration
+	rtt       int // kernel RTT in microseconds
+	failed    string
+}
+
+func (t probeTimings) String() string {
+	s := fmt.Sprintf("addr=%s dns_us=%d connect_us=%d handshake_us=%d rtt_us=%d",
+		t.addr, t.dns.Microseconds(), t.connect.Microseconds(), t.handshake.Microseconds(), t.rtt)
+	if len(t.failed) > 0 {
+		s += " failed=" + t.failed
+	}
+	return s
+}
+
+// Why a connection couldn't be made. Only the constants below are used so the reason label
+// stays bounded.
+const (
+	connectRefused     = "refused"     // the peer is up but nothing listens on the port
+	connectTimeout     = "timeout"     // no answer at all; the network path or the peer is down
+	connectUnreachable = "unreachable" // the network reported no route to the peer
+	connectOther       = "other"
+)
+
+var connectFailures = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "latency_connect_failures_total",
+		Help: "Failed connection attempts to the region by reason",
+	},
+	[]string{"to", "reason"},
+)
+
+func connectFailureReason(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return connectRefused
+	case errors.Is(err, syscall.ETIMEDOUT), errors.As(err, &netErr) && netErr.Timeout():
+		return connectTimeout
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return connectUnreachable
+	}
+	return connectOther
+}
+
+// a region being probed, and where its probe's time went
+type probeTarget struct {
+	r        *regionData
+	timings  probeTimings
+	holdLast bool // leave updating the region's last reading to the caller
+	measured bool // whether a reading made it into the histograms
+}
+
+func (t *probeTarget) fail(stage string) {
+	t.timings.failed = stage
+	t.r.recordFailure(stage)
+}
+
+// log the probe's timings if enabled, once it is over
+func (t *probeTarget) done() {
+	if conf().ProbeDebugLog {
+		log.Printf("P:\t%s\t%s\t%s", currRegion, t.r.region, t.timings)
+	}
+}
+
+// resolve a target's host:port to a dialable ip:port
+func resolveTarget(r *regionData) (string, error) {
+	host, port, err := net.SplitHostPort(r.host)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), conf().LatencyRefreshRate)
+	defer cancel()
+	addrs, err := lookupHostCached(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(addrs[0], port), nil
+}
+
+// Resolve a region ahead of probing it, separately from connecting so the two can be timed
+// apart. Returns nil if the region didn't resolve, which counts as a failed probe.
+func resolveProbeTarget(r *regionData) *probeTarget {
+	t := &probeTarget{r: r}
+	start := time.Now()
+	addr, err := resolveTarget(r)
+	t.timings.dns = time.Since(start)
+	if err != nil {
+		log.Printf("Unable to resolve %s: %v", r.region, err)
+		t.fail(stageDns)
+		t.done()
+		return nil
+	}
+	t.timings.addr = addr
+	r.recordAddress(addr)
+	return t
+}
+
+func probeRegion(r *regionData) {
+	if conf().StableProbes > 1 {
+		probeUntilStable(r)
+		return
+	}
+	t := resolveProbeTarget(r)
+	if t == nil {
+		return
+	}
+	probeTargets(t.timings.addr, []*probeTarget{t})
+	t.done()
+}
+
+// Probe regions that resolve to the same peer over a shared connection, up to n per connection,
+// so a peer hosting several targets isn't dialled once for each of them
+func probePipelined(regions []*regionData, n int) {
+	var addrs []string
+	byAddr := make(map[string][]*probeTarget)
+	for _, r := range regions {
+		if r.isRemoved() {
+			continue
+		}
+		t := resolveProbeTarget(r)
+		if t == nil {
+			continue
+		}
+		addr := t.timings.addr
+		if r.external() {
+			// external targets can't answer pings
+			probeTargets(addr, []*probeTarget{t})
+			t.done()
+			continue
+		}
+		if _, ok := byAddr[addr]; !ok {
+			addrs = append(addrs, addr)
+		}
+		byAddr[addr] = append(byAddr[addr], t)
+	}
+	for _, addr := range addrs {
+		targets := byAddr[addr]
+		for len(targets) > 0 {
+			k := n
+			if k > len(targets) {
+				k = len(targets)
+			}
+			// whatever couldn't be pipelined gets a connection of its own, once the shared one
+			// is closed so a pinned source port is free again
+			for _, t := range probeTargets(addr, targets[:k]) {
+				probeTargets(addr, []*probeTarget{t})
+			}
+			for _, t := range targets[:k] {
+				t.done()
+			}
+			targets = targets[k:]
+		}
+	}
+}
+
+// Probe the targets at addr over one connection. The first is measured by the handshake and
+// the rest by pipelined pings, if the peer is new enough to answer them. Returns the targets
+// that still need probing.
+func probeTargets(addr string, targets []*probeTarget) []*probeTarget {
+	first := targets[0]
+	r := first.r
+
+	// connect over TCP to the server
+	start := time.Now()
+	conn, err := probeDialer().Dial("tcp", addr)
+	connect := time.Since(start)
+	for _, t := range targets {
+		t.timings.connect = connect
+	}
+	if err != nil {
+		reason := connectFailureReason(err)
+		log.Printf("Unable to connect to %s (%s): %v", r.region, reason, err)
+		for _, t := range targets {
+			connectFailures.WithLabelValues(t.r.region, reason).Inc()
+			t.fail(stageConnect)
+			if host, _, err := net.SplitHostPort(t.r.host); err == nil {
+				evictHost(host)
+			}
+		}
+		return nil
+	}
+	held := false
+	defer func() {
+		if !held {
+			conn.Close()
+		}
+	}()
+	// a peer that stops answering, such as a server waiting for a token this client doesn't
+	// have, mustn't stall the probe loop
+	conn.SetDeadline(time.Now().Add(conf().LatencyRefreshRate))
+	connected := time.Now()
+	for _, t := range targets {
+		connectSuccesses.WithLabelValues(t.r.region).Inc()
+	}
+	if r.external() {
+		// an external service doesn't speak the handshake, so the kernel's RTT from
+		// connecting is all there is to measure
+		recordProbe(first, conn.(*net.TCPConn), r.region)
+		return nil
+	}
+
+	// tell the server your source region, in the binary format once the server is known to
+	// understand it
+	token := conf().HandshakeToken
+	var hello []byte
+	if conf().HandshakeFormat == formatBinary && r.peerVersion >= binaryVersion {
+		hello, err = binaryHello{version: handshakeVersion, region: currRegion, token: token}.encode()
+	} else {
+		text := announcement(currRegion, handshakeVersion)
+		if len(token) > 0 {
+			text += authFrame(token)
+		}
+		hello = []byte(text)
+	}
+	if err == nil {
+		_, err = conn.Write(hello)
+	}
+	if err != nil {
+		log.Printf("Unable to send handshake to %s: %v", r.region, err)
+		for _, t := range targets {
+			t.fail(stageHandshake)
+		}
+		return nil
+	}
+
+	// read the server's region; the server announces itself as soon as it accepts, so the
+	// wait for it approximates one round trip as seen by the application
+	br := bufio.NewReader(conn)
+	scanner := bufio.NewScanner(br)
+	binary, err := speaksBinary(br)
+	if err != nil {
+		log.Printf("No handshake from %s: %v", r.region, err)
+		for _, t := range targets {
+			t.fail(stageHandshake)
+		}
+		return nil
+	}
+	first.timings.handshake = time.Since(connected)
+	var serverRegion string
+	var version int
+	if binary {
+		var h binaryHello
+		h, err = readBinaryHello(br)
+		serverRegion, version = h.region, h.version
+	} else if scanner.Scan() {
+		serverRegion, version, err = parseAnnouncement(scanner.Text())
+	} else {
+		err = scannerErr(scanner)
+	}
+	if err != nil {
+		log.Printf("Incompatible handshake from %s: %v", r.region, err)
+		for _, t := range targets {
+			incompatibleHandshakes.WithLabelValues(t.r.region).Inc()
+			t.fail(stageHandshake)
+		}
+		return nil
+	}
+	serverRegion = normalizeRegion(serverRegion, "handshake")
+	for _, t := range targets {
+		t.r.recordHandshakeVersion(version)
+		handshakeSuccesses.WithLabelValues(t.r.region).Inc()
+	}
+	recordProbe(first, conn.(*net.TCPConn), serverRegion)
+
+	rest := targets[1:]
+	if len(rest) > 0 && version < pipelineVersion {
+		log.Printf("%s doesn't answer pipelined pings, probing %d regions separately", addr, len(rest))
+	}
+	for seq := 1; len(rest) > 0 && version >= pipelineVersion; seq++ {
+		if !pingPipelined(conn.(*net.TCPConn), scanner, rest[0], seq) {
+			break
+		}
+		rest = rest[1:]
+	}
+	// Let the server measure us in turn. A pinned source port must be free for the next
+	// probe straight away, so then the connection isn't held.
+	if version >= reverseVersion && conf().ProbeSourcePort == 0 {
+		held = true
+		go holdForServer(conn, scanner, r.region)
+	}
+	return rest
+}
+
+// Measure one more target over an established connection. Returns false if the connection
+// is no longer usable.
+func pingPipelined(conn *net.TCPConn, scanner *bufio.Scanner, t *probeTarget, seq int) bool {
+	sent := time.Now()
+	conn.SetDeadline(sent.Add(conf().LatencyRefreshRate))
+	if _, err := io.WriteString(conn, pingFrame(seq, t.r.region)); err != nil {
+		log.Printf("Unable to send pipelined ping for %s: %v", t.r.region, err)
+		return false
+	}
+	if !scanner.Scan() {
+		log.Printf("No reply to pipelined ping for %s: %v", t.r.region, scannerErr(scanner))
+		return false
+	}
+	gotSeq, target, ok := parsePong(scanner.Text())
+	if !ok || gotSeq != seq || target != t.r.region {
+		log.Printf("Unexpected reply to pipelined ping %d for %s: %q", seq, t.r.region, scanner.Text())
+		return false
+	}
+	t.timings.handshake = time.Since(sent)
+	recordProbe(t, conn, target)
+	return true
+}
+
+// Probe connections are short lived, so on a connection of their own this is normally the
+// initial window. A lower value, or one falling on pipelined connections, means the kernel
+// has seen loss on the path.
+var sndCwnd = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "latency_snd_cwnd_packets",
+		Help: "TCP congestion window of the latest probe connection in packets",
+	},
+	[]string{"to"},
+)
+
+// Take the kernel's RTT on conn and record it, along with the application level round trip
+// already in the target's timings
+func recordProbe(t *probeTarget, conn *net.TCPConn, serverRegion string) {
+	r := t.r
+	appLatency := t.timings.handshake.Microseconds()
+	handshaken := !r.external() // external targets are only connected to
+
+	// get the RTT
+	info, err := tcpOsInfo(conn)
+	if err != nil {
+		log.Printf("Unable to extract rtt from tcp conn on client to %s: %v", r.region, err)
+		t.fail(stageRtt)
+		return
+	}
+	latency := int(info.Rtt)
+	t.timings.rtt = latency
+	sndCwnd.WithLabelValues(r.region).Set(float64(info.Snd_cwnd))
+	recordTcpInfoFields(r, info)
+	if conf().OverlayMtu > 0 {
+		recordPathMtu(r, info)
+	}
+
+	if warmingUp() {
+		log.Printf("Discarding rtt of %dµs to %s during warmup", latency, r.region)
+		return
+	}
+
+	// update the prometheus metrics
+	if handshaken {
+		r.observe(methodHandshake, float64(appLatency))
+	}
+	if latency < conf().MinRttMicroseconds {
+		// no real network is this fast; the kernel hasn't got a usable sample
+		log.Printf("Discarding implausible rtt of %dµs to %s", latency, r.region)
+		invalidReadings.WithLabelValues(r.region).Inc()
+		return
+	}
+	r.observe(methodTcpInfo, float64(latency))
+	t.measured = true
+	if latency > 0 && handshaken {
+		appToKernelRatio.WithLabelValues(r.region).Set(float64(appLatency) / float64(latency))
+	}
+	r.detectPathChange(latency)
+	if !t.holdLast {
+		r.recordSuccess(latency)
+	}
+
+	log.Printf("C:\t%s\t%s\t%d", currRegion, serverRegion, latency)
+}
+
+// the error that stopped a scanner, which is nil when it stopped at EOF
+func scannerErr(s *bufio.Scanner) error {
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
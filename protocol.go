@@ -0,0 +1,129 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The handshake version spoken by this build. Both ends announce themselves with a line of the
+// form "LM/<version> <region>". Peers from before versioning send a bare region line, which is
+// treated as version 0.
+const handshakeVersion = 4
+
+// The first handshake version whose servers answer pipelined pings
+const pipelineVersion = 2
+
+const handshakePrefix = "LM/"
+
+// When the server sends its announcement, see ServerAnnounce
+const (
+	announceFirst       = "first"        // as soon as a client connects
+	announceAfterClient = "after_client" // once the client has announced itself, negotiating the version
+)
+
+// The line announcing region to a peer, speaking the given handshake version
+func announcement(region string, version int) string {
+	return fmt.Sprintf("%s%d %s\n", handshakePrefix, version, region)
+}
+
+// After the handshake a client may measure further targets hosted by the same peer over the
+// same connection. Each ping frame "PING <seq> <target>" is answered by "PONG <seq> <target>",
+// so a reply can be matched to its request.
+const (
+	pingVerb = "PING"
+	pongVerb = "PONG"
+)
+
+func pingFrame(seq int, target string) string {
+	return fmt.Sprintf("%s %d %s\n", pingVerb, seq, target)
+}
+
+func pongFrame(seq int, target string) string {
+	return fmt.Sprintf("%s %d %s\n", pongVerb, seq, target)
+}
+
+// Split a frame with the given verb into its sequence number and target
+func parseFrame(verb, line string) (seq int, target string, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != verb {
+		return 0, "", false
+	}
+	seq, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, "", false
+	}
+	return seq, fields[2], true
+}
+
+// Sent by the client straight after its announcement when a handshake token is configured
+const authPrefix = "AUTH "
+
+func authFrame(token string) string {
+	return authPrefix + token + "\n"
+}
+
+// the token in an AUTH frame
+func parseAuth(line string) (token string, ok bool) {
+	if !strings.HasPrefix(line, authPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(line, authPrefix), true
+}
+
+func parsePing(line string) (int, string, bool) { return parseFrame(pingVerb, line) }
+
+func parsePong(line string) (int, string, bool) { return parseFrame(pongVerb, line) }
+
+// Split a peer's announcement into its region and handshake version. An error means the peer
+// isn't speaking this protocol, or is speaking an incompatible version of it, so the line
+// must not be mistaken for a region.
+func parseAnnouncement(line string) (region string, version int, err error) {
+	region = line
+	if strings.HasPrefix(line, handshakePrefix) {
+		v, r, ok := strings.Cut(strings.TrimPrefix(line, handshakePrefix), " ")
+		version, err = strconv.Atoi(v)
+		if !ok || err != nil || version < 0 {
+			return "", 0, fmt.Errorf("malformed announcement %q", line)
+		}
+		region = r
+	}
+	if err := validateRegion(region); err != nil {
+		return "", 0, fmt.Errorf("announcement %q: %w", line, err)
+	}
+	return region, version, nil
+}
+
+var incompatibleHandshakes = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "latency_handshake_incompatible_total",
+		Help: "Probes whose server announced itself in a way this version can't parse",
+	},
+	[]string{"to"},
+)
+
+// Set to 1 for the version each peer last announced, so a rolling deploy shows which peers
+// have moved to a new handshake
+var handshakeVersions = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "latency_handshake_version",
+		Help: "Handshake version last announced by the region",
+	},
+	[]string{"to", "version"},
+)
+
+func (r *regionData) recordHandshakeVersion(version int) {
+	if version == r.peerVersion {
+		return
+	}
+	if r.peerVersion >= 0 {
+		handshakeVersions.DeleteLabelValues(r.region, strconv.Itoa(r.peerVersion))
+	}
+	r.peerVersion = version
+	handshakeVersions.WithLabelValues(r.region, strconv.Itoa(version)).Set(1)
+}
@@ -0,0 +1,55 @@
+//go:build linux
+
+package main
+
+import "math"
+
+// the latest n samples, oldest first
+func (s *sampleRing) recent(n int) []sample {
+	if n > s.count {
+		n = s.count
+	}
+	samples := make([]sample, n)
+	for i := range samples {
+		samples[i] = s.buf[(s.next-n+i+len(s.buf))%len(s.buf)]
+	}
+	return samples
+}
+
+// Whether enough of the region's recent probes succeeded to trust its latest reading. Always
+// true while no quorum is configured. Must be called with regionsMu held.
+func (r *regionData) quorate() bool {
+	c := conf()
+	if c.QuorumSize <= 0 {
+		return true
+	}
+	// a quorum larger than the probes considered could never be met
+	need := c.QuorumSize
+	if need > c.QuorumProbes {
+		need = c.QuorumProbes
+	}
+	var succeeded int
+	for _, smp := range r.samples.recent(c.QuorumProbes) {
+		if !math.IsNaN(smp.latency) {
+			succeeded++
+		}
+	}
+	return succeeded >= need
+}
+
+// Keep the last reading taken while the region had a quorum, to display in its place once it
+// loses it. Must be called with regionsMu held, after recording an outcome.
+func (r *regionData) updateStable() {
+	if r.quorate() {
+		r.stable = r.last
+	}
+}
+
+// The latency to display for the region, and whether it is a stale value standing in for the
+// latest reading because too few recent probes succeeded. Must be called with regionsMu held.
+func (r *regionData) displayed() (float64, bool) {
+	if r.quorate() {
+		return r.last, false
+	}
+	return r.stable, true
+}
@@ -0,0 +1,78 @@
+//go:build linux
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// A single latency observation as recorded into the prometheus histograms, handed to every
+// other exporter and result callback so they all see the same data
+type Reading struct {
+	From    string
+	To      string
+	Method  probeMethod
+	Latency float64 // microseconds
+	At      time.Time
+}
+
+// Called for every reading on the probing goroutine. Hooks are the built in exporters, which
+// queue or aggregate without waiting. They are registered during startup, before probing
+// begins, and must not block.
+var readingHooks []func(Reading)
+
+func addReadingHook(hook func(Reading)) {
+	readingHooks = append(readingHooks, hook)
+}
+
+// Result callbacks waiting to be handed a reading
+const resultBufferSize = 4096
+
+var (
+	resultCallbacks  []func(Reading)
+	pendingResults   = make(chan Reading, resultBufferSize)
+	startResultsOnce sync.Once
+	droppedResults   = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "latency_results_dropped_total",
+			Help: "Readings not handed to result callbacks because the callbacks fell behind",
+		},
+	)
+)
+
+// OnResult registers a callback for every reading, for code built around the prober that
+// wants to log, alert or keep metrics of its own. Callbacks may be slow: they run one reading
+// at a time on a goroutine of their own, fed through a buffer, and once the buffer is full
+// readings are dropped for them and counted rather than delaying the next probe. Register
+// callbacks during startup, before probing begins.
+func OnResult(callback func(Reading)) {
+	resultCallbacks = append(resultCallbacks, callback)
+	startResultsOnce.Do(func() { go dispatchResults() })
+}
+
+// hand queued readings to the result callbacks
+func dispatchResults() {
+	for rd := range pendingResults {
+		for _, callback := range resultCallbacks {
+			callback(rd)
+		}
+	}
+}
+
+func emitReading(rd Reading) {
+	for _, hook := range readingHooks {
+		hook(rd)
+	}
+	if len(resultCallbacks) == 0 {
+		return
+	}
+	select {
+	case pendingResults <- rd:
+	default:
+		droppedResults.Inc()
+	}
+}
@@ -0,0 +1,24 @@
+//go:build linux
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOnResultReceivesReadings(t *testing.T) {
+	got := make(chan Reading, 1)
+	OnResult(func(rd Reading) { got <- rd })
+
+	want := Reading{From: "iad", To: "lhr", Method: methodTcpInfo, Latency: 71234, At: time.Now()}
+	emitReading(want)
+	select {
+	case rd := <-got:
+		if rd != want {
+			t.Errorf("callback got %+v, want %+v", rd, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("callback wasn't called")
+	}
+}
@@ -0,0 +1,184 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var rejectedRegions = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "latency_regions_rejected_total",
+		Help: "Region names from discovery that were rejected as invalid",
+	},
+)
+
+// Check that a discovered region name is usable. Region names end up in hostnames and metrics,
+// so anything that isn't a single DNS label is rejected rather than risking a bad hostname
+// or a panic when registering metrics.
+func validateRegion(name string) error {
+	if len(name) == 0 {
+		return errors.New("empty region name")
+	}
+	if len(name) > 63 {
+		return fmt.Errorf("region name %q is longer than a DNS label", name)
+	}
+	for _, c := range name {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-' && name[0] != '-' && name[len(name)-1] != '-':
+		default:
+			return fmt.Errorf("region name %q contains %q", name, c)
+		}
+	}
+	return nil
+}
+
+// Ways of normalizing the case of region names, see RegionCase
+const (
+	caseLower    = "lower"
+	caseUpper    = "upper"
+	casePreserve = "preserve"
+)
+
+var normalizedRegions = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "latency_regions_normalized_total",
+		Help: "Region names whose case was changed to match RegionCase",
+	},
+	[]string{"source"},
+)
+
+// Bring a region name to the configured case, so a peer that reports IAD rather than iad
+// doesn't show up as a separate region. source says where the name came from when counting
+// names that had to change.
+func normalizeRegion(name, source string) string {
+	normalized := inRegionCase(name, conf().RegionCase)
+	if normalized != name {
+		normalizedRegions.WithLabelValues(source).Inc()
+	}
+	return normalized
+}
+
+// a region name in the given RegionCase
+func inRegionCase(name, regionCase string) string {
+	switch regionCase {
+	case caseLower:
+		return strings.ToLower(name)
+	case caseUpper:
+		return strings.ToUpper(name)
+	}
+	return name
+}
+
+// Make a region name safe to embed in a metric name, which unlike a hostname can't contain
+// dashes
+func metricNameFragment(name string) string {
+	return strings.Map(func(c rune) rune {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '_':
+			return c
+		}
+		return '_'
+	}, name)
+}
+
+// Add any regions from discovery that aren't known yet. Invalid names are logged, counted and
+// skipped so that bad TXT content can't take the process down.
+func addRegions(entries []string) {
+	regionsMu.Lock()
+	defer regionsMu.Unlock()
+	for _, r := range entries {
+		r = normalizeRegion(strings.TrimSpace(r), "discovery")
+		if _, ok := regionLatencies[r]; ok {
+			continue
+		}
+		if err := validateRegion(r); err != nil {
+			log.Printf("Ignoring discovered region: %v", err)
+			rejectedRegions.Inc()
+			continue
+		}
+		regionLatencies[r] = NewRegion(r)
+	}
+}
+
+// Stop probing a region and delete its series, which would otherwise keep reporting their
+// last values. Must be called with regionsMu held.
+func removeRegion(r *regionData) {
+	delete(regionLatencies, r.region)
+	r.removed = true
+	forgetRegion(r)
+}
+
+// Delete every series labelled with a removed region. A probe of the region still in flight
+// can bring some back, so the prober forgets it again at the end of the cycle. Must be called
+// with regionsMu held.
+func forgetRegion(r *regionData) {
+	to := prometheus.Labels{"to": r.region}
+	vecs := []interface{ DeletePartialMatch(prometheus.Labels) int }{
+		latencyHist, primaryLatencyHist, reverseLatencyHist,
+		lastLatency, appToKernelRatio, sndCwnd, probeIntervals, pathMtu, fragmentationDetected,
+		bidirectionalOk, handshakeVersions, cnameChainLength, cnameTarget,
+		probeFailures, invalidReadings, connectSuccesses, connectFailures, handshakeSuccesses,
+		incompatibleHandshakes, pathChanges, ipChanges, unsettledTicks,
+	}
+	for _, g := range tcpInfoGauges {
+		vecs = append(vecs, g)
+	}
+	for _, v := range vecs {
+		v.DeletePartialMatch(to)
+	}
+	if r.legacyHist == nil {
+		return
+	}
+	// regions whose names sanitize alike share the legacy histogram
+	for _, other := range regionLatencies {
+		if other.legacyHist == r.legacyHist {
+			return
+		}
+	}
+	prometheus.Unregister(r.legacyHist)
+}
+
+// whether the region was removed, so it shouldn't be probed any more
+func (r *regionData) isRemoved() bool {
+	regionsMu.RLock()
+	defer regionsMu.RUnlock()
+	return r.removed
+}
+
+// Forget the regions of a probe cycle that were removed while it ran, unless a region by the
+// same name has taken their place
+func forgetRemoved(regions []*regionData) {
+	regionsMu.Lock()
+	defer regionsMu.Unlock()
+	for _, r := range regions {
+		if _, ok := regionLatencies[r.region]; r.removed && !ok {
+			forgetRegion(r)
+		}
+	}
+}
+
+// Register the legacy per-name histogram for a region. Sanitizing can map distinct regions to
+// the same name; those share the already registered histogram rather than panicking.
+func registerLegacyHist(r string) prometheus.Histogram {
+	hist := prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name: fmt.Sprintf("latency_%s_to_%s_microsecond", metricNameFragment(currRegion), metricNameFragment(r)),
+		})
+	if err := prometheus.Register(hist); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			return are.ExistingCollector.(prometheus.Histogram)
+		}
+		log.Printf("Unable to register legacy histogram for %s: %v", r, err)
+		return nil
+	}
+	return hist
+}
@@ -0,0 +1,83 @@
+//go:build linux
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAddRegionsSanitizesNames(t *testing.T) {
+	c := defaultConfig()
+	c.LegacyMetricNames = true
+	activeConfig.Store(c)
+	currRegion, appName = "iad", "latency-test"
+	if latencyHist == nil {
+		initLatencyMetrics(c)
+	}
+
+	tests := []struct {
+		name   string
+		region string // the region added, empty when the name should be rejected
+	}{
+		{name: "lhr", region: "lhr"},
+		{name: "us-west-2", region: "us-west-2"},
+		{name: " syd ", region: "syd"},
+		{name: "", region: ""},
+		{name: "   ", region: ""},
+		{name: "-ams", region: ""},
+		{name: "ams-", region: ""},
+		{name: "fra.internal", region: ""},
+		{name: "sj c", region: ""},
+		{name: "us_east", region: ""},
+		{name: "münchen", region: ""},
+		{name: "東京", region: ""},
+		{name: strings.Repeat("a", 64), region: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rejected := testutil.ToFloat64(rejectedRegions)
+			defer func() {
+				if p := recover(); p != nil {
+					t.Fatalf("addRegions(%q) panicked: %v", tt.name, p)
+				}
+			}()
+			addRegions([]string{tt.name})
+
+			if len(tt.region) == 0 {
+				if got := testutil.ToFloat64(rejectedRegions) - rejected; got != 1 {
+					t.Errorf("addRegions(%q) counted %v rejections, want 1", tt.name, got)
+				}
+				if _, ok := regionLatencies[tt.name]; ok {
+					t.Errorf("addRegions(%q) added the region", tt.name)
+				}
+				return
+			}
+			r, ok := regionLatencies[tt.region]
+			if !ok {
+				t.Fatalf("addRegions(%q) didn't add %q", tt.name, tt.region)
+			}
+			// registration fails for an invalid metric name, leaving no histogram
+			if r.legacyHist == nil {
+				t.Errorf("addRegions(%q) didn't register a legacy histogram", tt.name)
+			}
+		})
+	}
+}
+
+func TestConfiguredRegionsFollowRegionCase(t *testing.T) {
+	t.Setenv("PRIMARY_REGION", "IAD")
+	t.Setenv("SLO_TARGETS", "*=p99<50ms,SYD=p99<120ms")
+	c, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.PrimaryRegion != "iad" {
+		t.Errorf("PRIMARY_REGION=IAD loaded as %q, want iad", c.PrimaryRegion)
+	}
+	if target, _ := c.sloTarget("syd"); target.threshold != 120000 {
+		t.Errorf("syd got the SLO target %+v, want its own p99<120ms", target)
+	}
+}
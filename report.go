@@ -0,0 +1,64 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+// A consolidated view of the latest reading to every region, keyed by region. Regions without a
+// reading are null. Regions short of a quorum show their last stable reading and are listed
+// in Stale. ServerLatencies holds the latest reading this region's ping server took of each
+// client region, the other direction of the matrix. Recent annotations are included so events
+// can be lined up with readings.
+type latencyReport struct {
+	Time            time.Time           `json:"time"`
+	From            string              `json:"from"`
+	Latencies       map[string]*float64 `json:"latencies"`
+	Stale           []string            `json:"stale,omitempty"`
+	ServerLatencies map[string]int      `json:"server_latencies,omitempty"`
+	Annotations     []annotation        `json:"annotations,omitempty"`
+}
+
+func newLatencyReport() latencyReport {
+	annotations := recentAnnotations()
+	serverLatencies := lastServerLatencies()
+	regionsMu.RLock()
+	defer regionsMu.RUnlock()
+	report := latencyReport{
+		Time:            time.Now().UTC(),
+		From:            currRegion,
+		Latencies:       make(map[string]*float64, len(regionLatencies)),
+		ServerLatencies: serverLatencies,
+		Annotations:     annotations,
+	}
+	for _, r := range regionLatencies {
+		last, stale := r.displayed()
+		if stale {
+			report.Stale = append(report.Stale, r.region)
+		}
+		if math.IsNaN(last) {
+			report.Latencies[r.region] = nil
+			continue
+		}
+		report.Latencies[r.region] = &last
+	}
+	sort.Strings(report.Stale)
+	return report
+}
+
+// Periodically write the whole latency matrix to stdout as one JSON line, for log pipelines
+// that would rather not scrape the http endpoint
+func reportToStdout(ticker *time.Ticker) {
+	enc := json.NewEncoder(os.Stdout)
+	for range ticker.C {
+		if err := enc.Encode(newLatencyReport()); err != nil {
+			log.Printf("Unable to write latency report: %v", err)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+//go:build linux
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUnmeasuredRegionReportsNull(t *testing.T) {
+	c := defaultConfig()
+	activeConfig.Store(c)
+	currRegion, appName = "iad", "latency-test"
+	if latencyHist == nil {
+		initLatencyMetrics(c)
+	}
+	regionsMu.Lock()
+	regionLatencies["nrt"] = NewRegion("nrt")
+	regionsMu.Unlock()
+	t.Cleanup(func() {
+		regionsMu.Lock()
+		delete(regionLatencies, "nrt")
+		regionsMu.Unlock()
+	})
+
+	if latency, ok := newLatencyReport().Latencies["nrt"]; !ok || latency != nil {
+		t.Errorf("unmeasured region reported as %v, want null", latency)
+	}
+	regionLatencies["nrt"].recordSuccess(int((71 * time.Millisecond).Microseconds()))
+	if latency := newLatencyReport().Latencies["nrt"]; latency == nil || *latency != 71000 {
+		t.Errorf("measured region reported as %v, want 71000", latency)
+	}
+}
@@ -0,0 +1,96 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The first handshake version whose clients hold the connection open at the end of a probe
+// for the server to measure them in turn
+const reverseVersion = 3
+
+// Frames closing a connection from version 3 clients. After its own measurements the client
+// sends HOLD. A server doing reverse probes then pings the client, which answers like a server
+// answers a pipelined ping, and either way the server finishes with DONE.
+const (
+	holdFrame = "HOLD\n"
+	doneFrame = "DONE\n"
+)
+
+// RTT measured by this server actively probing a connected client, from our region to the
+// client's. Created by initLatencyMetrics.
+var reverseLatencyHist *prometheus.HistogramVec
+
+// Serve the server's reverse probe once the client is done with its own measurements. Runs
+// off the probing loop so waiting for the server doesn't hold up the next probe, and owns
+// conn from then on.
+func holdForServer(conn net.Conn, scanner *bufio.Scanner, region string) {
+	defer conn.Close()
+	// every frame from the server is a round trip away, so the wait starts over for each
+	conn.SetDeadline(time.Now().Add(conf().LatencyRefreshRate))
+	if _, err := io.WriteString(conn, holdFrame); err != nil {
+		return
+	}
+	for scanner.Scan() {
+		conn.SetDeadline(time.Now().Add(conf().LatencyRefreshRate))
+		seq, target, ok := parsePing(scanner.Text())
+		if !ok {
+			if scanner.Text()+"\n" != doneFrame {
+				log.Printf("Unexpected frame from %s while holding: %q", region, scanner.Text())
+			}
+			return
+		}
+		io.WriteString(conn, pongFrame(seq, target))
+	}
+}
+
+// Ping a client that is holding its connection open, measuring the direction from us to it
+// on the same connection it probed us over
+func reverseProbe(c *net.TCPConn, scanner *bufio.Scanner, clientRegion, peer string) {
+	defer io.WriteString(c, doneFrame)
+	if !conf().ReverseProbes {
+		return
+	}
+	c.SetReadDeadline(time.Now().Add(conf().LatencyRefreshRate))
+	sent := time.Now()
+	if _, err := io.WriteString(c, pingFrame(1, clientRegion)); err != nil {
+		log.Printf("Unable to send reverse probe to %s: %v", peer, err)
+		return
+	}
+	if !scanner.Scan() {
+		log.Printf("No reply to reverse probe from %s: %v", peer, scannerErr(scanner))
+		return
+	}
+	if seq, target, ok := parsePong(scanner.Text()); !ok || seq != 1 || target != clientRegion {
+		log.Printf("Unexpected reply to reverse probe from %s: %q", peer, scanner.Text())
+		return
+	}
+	appLatency := time.Since(sent).Microseconds()
+
+	latency, err := tcpOsRtt(c)
+	if err != nil {
+		log.Printf("Unable to extract rtt from tcp conn on reverse probe to %s: %v", peer, err)
+		return
+	}
+	recordReverseLatency(clientRegion, methodHandshake, float64(appLatency))
+	recordReverseLatency(clientRegion, methodTcpInfo, float64(latency))
+	log.Printf("R:\t%s\t%s\t%d\t%s", currRegion, clientRegion, latency, peer)
+}
+
+// Like server side readings, only recorded for regions that discovery knows about and once
+// warmed up
+func recordReverseLatency(clientRegion string, method probeMethod, latency float64) {
+	regionsMu.RLock()
+	_, known := regionLatencies[clientRegion]
+	regionsMu.RUnlock()
+	if known && !warmingUp() {
+		reverseLatencyHist.WithLabelValues(currRegion, clientRegion, string(method)).Observe(latency)
+	}
+}
@@ -0,0 +1,107 @@
+//go:build linux
+
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The regions due a probe at now. A region is due once its interval has elapsed since it was
+// last scheduled, give or take half a tick so ticker jitter doesn't push it to the next tick.
+func dueRegions(now time.Time) []*regionData {
+	slack := conf().LatencyRefreshRate / 2
+	var due []*regionData
+	for _, r := range snapshotRegions() {
+		if !now.Add(slack).Before(r.nextProbe) {
+			due = append(due, r)
+		}
+	}
+	return due
+}
+
+// mark a region as probed at now and work out when it is next due
+func (r *regionData) schedule(now time.Time) {
+	interval := r.probeInterval()
+	if conf().AdaptiveMaxInterval > 0 {
+		interval = r.adaptInterval(interval)
+	}
+	probeIntervals.WithLabelValues(r.region).Set(interval.Seconds())
+	r.nextProbe = now.Add(interval)
+}
+
+var probeIntervals = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "latency_probe_interval_seconds",
+		Help: "Interval until the region's next probe as last scheduled",
+	},
+	[]string{"to"},
+)
+
+// Jitter, as the RTT's coefficient of variation over the stats window, that keeps a region on
+// its base interval. Steadier regions are probed less often and noisier ones more often.
+const adaptiveTargetCv = 0.05
+
+// Samples in the window before a region's statistics are trusted to adapt its interval
+const adaptiveMinSamples = 5
+
+// Scale a region's interval by how stable its latency is, within the configured bounds. A
+// region that failed any probe in the window is probed as often as allowed.
+func (r *regionData) adaptInterval(base time.Duration) time.Duration {
+	c := conf()
+	lo, hi := c.AdaptiveMinInterval, c.AdaptiveMaxInterval
+	if lo <= 0 {
+		lo = c.LatencyRefreshRate
+	}
+	if hi < lo {
+		hi = lo
+	}
+	st := r.windowStats()
+	interval := base
+	switch {
+	case st.probes < adaptiveMinSamples:
+	case st.availability < 1:
+		interval = lo
+	case st.stddev == 0:
+		interval = hi
+	default:
+		interval = time.Duration(float64(base) * adaptiveTargetCv / (st.stddev / st.mean))
+	}
+	if interval < lo {
+		return lo
+	}
+	if interval > hi {
+		return hi
+	}
+	return interval
+}
+
+// Latency to and from the primary is what a primary/replica deployment cares about, so pairs
+// involving it are probed every tick while replica to replica pairs use the coarser interval.
+// External targets aren't part of the deployment, so they're probed every tick too.
+func (r *regionData) probeInterval() time.Duration {
+	c := conf()
+	if len(c.PrimaryRegion) == 0 || r.involvesPrimary() || r.external() {
+		return c.LatencyRefreshRate
+	}
+	return c.ReplicaProbeInterval
+}
+
+func (r *regionData) involvesPrimary() bool {
+	primary := conf().PrimaryRegion
+	return len(primary) > 0 && (currRegion == primary || r.region == primary)
+}
+
+// Finer grained histogram for pairs involving the primary region, with buckets 25% apart
+// from 50µs to roughly 3.5s. Created by initLatencyMetrics.
+var primaryLatencyHist *prometheus.HistogramVec
+
+func primaryHistogramOpts() prometheus.HistogramOpts {
+	return prometheus.HistogramOpts{
+		Name:    "latency_primary_rtt_microseconds",
+		Help:    "TCP_INFO round trip time between the primary region and another region in microseconds",
+		Buckets: prometheus.ExponentialBuckets(50, 1.25, 50),
+	}
+}
@@ -0,0 +1,290 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The IP of a connected peer. A dual stack listener reports IPv4 clients as IPv4-mapped IPv6
+// addresses, so unless disabled these are unmapped to keep one client from looking like two.
+func peerIP(addr net.Addr) string {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	if conf().UnmapIPv4 {
+		return ap.Addr().Unmap().String()
+	}
+	return ap.Addr().String()
+}
+
+// listen for clients (peers) on TCP so they can measure latency to you. When httpConns is set
+// the port is shared with the http server, and connections that turn out to be http requests
+// are handed over to it.
+func runTcpPingServer(httpConns *connQueue) {
+	listener, err := net.Listen("tcp", ":"+conf().TcpPort)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	failures := 0
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			failures++
+			log.Printf("Failed to accept a client connection: %v", err)
+			// Transient errors such as running out of file descriptors clear up by themselves,
+			// but a closed listener, or one that keeps failing, is replaced
+			if errors.Is(err, net.ErrClosed) || failures >= acceptFailuresBeforeRelisten {
+				listener.Close()
+				listener = relisten()
+				failures = 0
+				continue
+			}
+			time.Sleep(acceptBackoff(failures))
+			continue
+		}
+		failures = 0
+		go func(c *net.TCPConn) {
+			if httpConns == nil {
+				handlePing(c, c)
+				return
+			}
+			rd := bufio.NewReader(c)
+			isHttp, err := sniffHttp(c, rd)
+			switch {
+			case err != nil:
+				log.Printf("Unable to identify protocol of connection from %s: %v", peerIP(c.RemoteAddr()), err)
+				c.Close()
+			case isHttp:
+				httpConns.push(&peekedConn{c, rd})
+			default:
+				handlePing(c, rd)
+			}
+		}(conn.(*net.TCPConn))
+	}
+}
+
+// Consecutive accept failures after which the listener is considered dead
+const acceptFailuresBeforeRelisten = 10
+
+var serverRestarts = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "latency_server_restarts_total",
+		Help: "Times the ping server's listener died and was re-created",
+	},
+)
+
+// how long to wait after the nth consecutive accept failure, doubling from 5ms to at most 1s
+func acceptBackoff(n int) time.Duration {
+	d := 5 * time.Millisecond << (n - 1)
+	if d > time.Second || d <= 0 {
+		return time.Second
+	}
+	return d
+}
+
+// Listen on TcpPort again, retrying with backoff until it works. Until then the region can't
+// be probed, but metrics and the http endpoints stay up.
+func relisten() net.Listener {
+	backoff := time.Second
+	for {
+		listener, err := net.Listen("tcp", ":"+conf().TcpPort)
+		if err == nil {
+			log.Printf("Ping server listening again on port %s", conf().TcpPort)
+			serverRestarts.Inc()
+			return listener
+		}
+		log.Printf("Unable to re-create the ping server's listener, retrying in %s: %v", backoff, err)
+		time.Sleep(backoff)
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// answer a client's probe; rd reads from c, possibly with some bytes already buffered
+func handlePing(c *net.TCPConn, rd io.Reader) {
+	defer c.Close()
+	peer := peerIP(c.RemoteAddr())
+	// send your region to the client, unless it should speak first. With a token, nothing is
+	// given away before the client has proven it belongs to the mesh.
+	token := conf().HandshakeToken
+	first := conf().ServerAnnounce == announceFirst && len(token) == 0
+	if first {
+		io.WriteString(c, announcement(currRegion, handshakeVersion))
+	}
+
+	// read the client's region, in whichever format it speaks. A client that never finishes
+	// its handshake, such as one without a token talking to a server with one, mustn't hold
+	// the connection open indefinitely; running out of time counts as a missing token.
+	c.SetReadDeadline(time.Now().Add(conf().LatencyRefreshRate))
+	br := bufio.NewReader(rd)
+	scanner := bufio.NewScanner(br)
+	var clientRegion, clientToken string
+	var clientVersion int
+	var hasToken bool
+	binary, _ := speaksBinary(br)
+	if binary {
+		h, err := readBinaryHello(br)
+		if err != nil {
+			log.Printf("Rejecting connection from %s: %v", peer, err)
+			rejectedHandshakes.WithLabelValues("malformed").Inc()
+			return
+		}
+		clientRegion, clientVersion = normalizeRegion(h.region, "handshake"), h.version
+		clientToken, hasToken = h.token, len(h.token) > 0
+	} else {
+		scanner.Scan()
+		var err error
+		clientRegion, clientVersion, err = parseAnnouncement(scanner.Text())
+		if err != nil {
+			// whatever this is, it isn't a client of ours; nor is a client that said nothing
+			log.Printf("Rejecting connection from %s: %v", peer, err)
+			rejectedHandshakes.WithLabelValues("malformed").Inc()
+			return
+		}
+		clientRegion = normalizeRegion(clientRegion, "handshake")
+		if len(token) > 0 {
+			scanner.Scan()
+			clientToken, hasToken = parseAuth(scanner.Text())
+		}
+	}
+	if len(token) > 0 {
+		if reason := checkHandshakeToken(clientToken, hasToken, token); len(reason) > 0 {
+			log.Printf("Rejecting connection from %s (%s): %s token", peer, clientRegion, reason)
+			rejectedHandshakes.WithLabelValues(reason).Inc()
+			return
+		}
+	}
+	if !first {
+		// answer in the client's format with the highest version both ends speak
+		version := handshakeVersion
+		if clientVersion < version {
+			version = clientVersion
+		}
+		if binary {
+			hello, _ := binaryHello{version: version, region: currRegion}.encode()
+			c.Write(hello)
+		} else {
+			io.WriteString(c, announcement(currRegion, version))
+		}
+	}
+
+	// record what the server's perceived latency is
+	latency, err := tcpOsRtt(c)
+	if err != nil {
+		log.Printf("Unable to extract rtt from tcp conn on server from %s: %v", peer, err)
+		return
+	}
+
+	recordServerLatency(clientRegion, latency)
+	log.Printf("S:\t%s\t%s\t%d\t%s", currRegion, clientRegion, latency, peer)
+
+	// answer pipelined pings until the client goes quiet, which also holds the conn open for
+	// the client so everything can close cleanly. Each frame takes a round trip to arrive, so
+	// the wait allows for the longest paths rather than a typical one.
+	for {
+		c.SetReadDeadline(time.Now().Add(conf().LatencyRefreshRate))
+		if !scanner.Scan() {
+			return
+		}
+		if scanner.Text()+"\n" == holdFrame {
+			reverseProbe(c, scanner, clientRegion, peer)
+			return
+		}
+		if _, ok := parseAuth(scanner.Text()); ok {
+			// a client that has a token while this server doesn't
+			continue
+		}
+		seq, target, ok := parsePing(scanner.Text())
+		if !ok {
+			log.Printf("Unexpected frame from %s: %q", peer, scanner.Text())
+			return
+		}
+		io.WriteString(c, pongFrame(seq, target))
+	}
+}
+
+var rejectedHandshakes = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "latency_handshake_rejected_total",
+		Help: "Client connections rejected for a malformed handshake or a missing or wrong token",
+	},
+	[]string{"reason"},
+)
+
+// Why the token a client presented, if any, doesn't authenticate it, or empty if it does
+func checkHandshakeToken(got string, present bool, token string) string {
+	if !present {
+		return "missing"
+	}
+	if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		return "wrong"
+	}
+	return ""
+}
+
+// The RTT this server saw on connections from a client region. Labelled like the client's own
+// measurement, from the client's region to ours, so the two views of a pair join on (from, to).
+// Created by initLatencyMetrics.
+var serverLatencyHist *prometheus.HistogramVec
+
+type serverRegionData struct {
+	hist       prometheus.Observer
+	last       int
+	lastUpdate time.Time
+}
+
+// server side observations keyed by the client's region
+var serverLatenciesMu sync.Mutex
+var serverLatencies = make(map[string]*serverRegionData)
+
+// Record a server side reading. Client regions are whatever the peer announced, so only regions
+// that discovery knows about are recorded in order to keep the label set bounded.
+func recordServerLatency(clientRegion string, latency int) {
+	regionsMu.RLock()
+	_, known := regionLatencies[clientRegion]
+	regionsMu.RUnlock()
+	if !known || warmingUp() {
+		return
+	}
+
+	serverLatenciesMu.Lock()
+	defer serverLatenciesMu.Unlock()
+	sr, ok := serverLatencies[clientRegion]
+	if !ok {
+		sr = &serverRegionData{hist: serverLatencyHist.WithLabelValues(clientRegion, currRegion)}
+		serverLatencies[clientRegion] = sr
+	}
+	sr.hist.Observe(float64(latency))
+	sr.last = latency
+	sr.lastUpdate = time.Now()
+}
+
+// The latest RTT this server saw from each client region, leaving out readings older than
+// the stats window since the client has evidently stopped probing
+func lastServerLatencies() map[string]int {
+	cutoff := time.Now().Add(-conf().StatsWindow)
+	serverLatenciesMu.Lock()
+	defer serverLatenciesMu.Unlock()
+	latencies := make(map[string]int, len(serverLatencies))
+	for region, sr := range serverLatencies {
+		if sr.lastUpdate.After(cutoff) {
+			latencies[region] = sr.last
+		}
+	}
+	return latencies
+}
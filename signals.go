@@ -0,0 +1,52 @@
+//go:build linux
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// handle signals sent by operators for the lifetime of the process
+func handleSignals(regionRefreshTicker, updateLatencyTicker *time.Ticker) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGUSR1)
+	for sig := range sigs {
+		switch sig {
+		case syscall.SIGHUP:
+			reloadConfig(regionRefreshTicker, updateLatencyTicker)
+		case syscall.SIGUSR1:
+			dumpGoroutines()
+		}
+	}
+}
+
+// re-read the configuration and apply whatever can be changed while running
+func reloadConfig(regionRefreshTicker, updateLatencyTicker *time.Ticker) {
+	c, err := loadConfig(conf())
+	if err != nil {
+		log.Printf("Config reload failed, keeping the running config: %v", err)
+		return
+	}
+	activeConfig.Store(c)
+	regionRefreshTicker.Reset(c.RegionRefreshRate)
+	updateLatencyTicker.Reset(c.LatencyRefreshRate)
+	log.Printf("Config reloaded")
+}
+
+// write the stacks of all goroutines to the log, growing the buffer until they fit
+func dumpGoroutines() {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			log.Printf("Goroutine dump (%d goroutines):\n%s", runtime.NumGoroutine(), buf[:n])
+			return
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
@@ -0,0 +1,81 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A latency objective such as p99<50ms: that fraction of probes succeeds in under the threshold
+type sloTarget struct {
+	quantile  float64
+	threshold float64 // microseconds
+}
+
+// Every region uses the target given for "*" unless it has one of its own
+const sloDefaultRegion = "*"
+
+// Parse SLO_TARGETS, comma separated region=target pairs such as "*=p99<50ms,syd=p99<120ms"
+func parseSloTargets(v string) (map[string]sloTarget, error) {
+	targets := make(map[string]sloTarget)
+	for _, entry := range strings.Split(v, ",") {
+		region, spec, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("%q isn't region=target", entry)
+		}
+		if region != sloDefaultRegion {
+			if err := validateRegion(region); err != nil {
+				return nil, err
+			}
+		}
+		target, err := parseSloTarget(spec)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", region, err)
+		}
+		targets[region] = target
+	}
+	return targets, nil
+}
+
+func parseSloTarget(spec string) (sloTarget, error) {
+	q, threshold, ok := strings.Cut(strings.TrimPrefix(spec, "p"), "<")
+	if !ok || !strings.HasPrefix(spec, "p") {
+		return sloTarget{}, fmt.Errorf("target %q isn't of the form p99<50ms", spec)
+	}
+	percentile, err := strconv.ParseFloat(q, 64)
+	if err != nil || percentile <= 0 || percentile >= 100 {
+		return sloTarget{}, fmt.Errorf("target %q needs a percentile between 0 and 100", spec)
+	}
+	d, err := time.ParseDuration(threshold)
+	if err != nil || d <= 0 {
+		return sloTarget{}, fmt.Errorf("target %q needs a positive duration", spec)
+	}
+	return sloTarget{quantile: percentile / 100, threshold: float64(d.Microseconds())}, nil
+}
+
+// the SLO target of a region, if any
+func (c *config) sloTarget(region string) (sloTarget, bool) {
+	if t, ok := c.sloTargets[region]; ok {
+		return t, true
+	}
+	t, ok := c.sloTargets[sloDefaultRegion]
+	return t, ok
+}
+
+// The fraction of the error budget left over the stats window. A p99 target allows 1% of
+// probes to be bad, either failing or slower than the threshold; 1 means none were, 0 that
+// the budget is spent and below 0 that it is overspent.
+func (st windowStats) sloBudgetRemaining(t sloTarget) float64 {
+	if st.probes == 0 {
+		return math.NaN()
+	}
+	// failed probes aren't among the sorted readings, so they count as bad too
+	fast := sort.SearchFloat64s(st.sorted, t.threshold)
+	bad := st.probes - fast
+	return 1 - float64(bad)/float64(st.probes)/(1-t.quantile)
+}
@@ -0,0 +1,116 @@
+//go:build linux
+
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestParseSloTargets(t *testing.T) {
+	tests := []struct {
+		value string
+		want  map[string]sloTarget // nil when the value should be rejected
+	}{
+		{value: "*=p99<50ms", want: map[string]sloTarget{"*": {0.99, 50000}}},
+		{value: "syd=p97.5<120ms", want: map[string]sloTarget{"syd": {0.975, 120000}}},
+		{
+			value: "*=p99<50ms, syd=p95<1.5s,us-west-2=p50<800us",
+			want: map[string]sloTarget{
+				"*":         {0.99, 50000},
+				"syd":       {0.95, 1500000},
+				"us-west-2": {0.5, 800},
+			},
+		},
+		{value: "*=p99<50ms,*=p90<10ms", want: map[string]sloTarget{"*": {0.9, 10000}}},
+		{value: ""},
+		{value: "p99<50ms"},
+		{value: "*=p99<50ms,"},
+		{value: "=p99<50ms"},
+		{value: "sy d=p99<50ms"},
+		{value: "-syd=p99<50ms"},
+		{value: "syd.internal=p99<50ms"},
+		{value: "**=p99<50ms"},
+		{value: "syd=99<50ms"},
+		{value: "syd=p99"},
+		{value: "syd=p99>50ms"},
+		{value: "syd=p<50ms"},
+		{value: "syd=pxx<50ms"},
+		{value: "syd=p0<50ms"},
+		{value: "syd=p100<50ms"},
+		{value: "syd=p-5<50ms"},
+		{value: "syd=p99<50"},
+		{value: "syd=p99<0ms"},
+		{value: "syd=p99<-50ms"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseSloTargets(tt.value)
+			if tt.want == nil {
+				if err == nil {
+					t.Errorf("parseSloTargets(%q) = %v, want an error", tt.value, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSloTargets(%q): %v", tt.value, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSloTargets(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSloTargetFallsBackToDefault(t *testing.T) {
+	c := defaultConfig()
+	c.sloTargets = map[string]sloTarget{"syd": {0.99, 120000}}
+	if target, ok := c.sloTarget("lhr"); ok {
+		t.Errorf("lhr has target %v without a default, want none", target)
+	}
+	c.sloTargets[sloDefaultRegion] = sloTarget{0.99, 50000}
+	for region, want := range map[string]float64{"syd": 120000, "lhr": 50000} {
+		if target, ok := c.sloTarget(region); !ok || target.threshold != want {
+			t.Errorf("%s has target %v, want a threshold of %v", region, target, want)
+		}
+	}
+}
+
+func TestSloBudgetRemaining(t *testing.T) {
+	// 100 probes, p90<50ms allows 10 bad ones
+	target := sloTarget{quantile: 0.9, threshold: 50000}
+	tests := []struct {
+		name       string
+		slow, fail int // out of a 100 probes, the rest are fast
+		want       float64
+	}{
+		{name: "all fast", want: 1},
+		{name: "at the threshold counts as slow", slow: 5, want: 0.5},
+		{name: "failures are bad", fail: 5, want: 0.5},
+		{name: "spent", slow: 6, fail: 4, want: 0},
+		{name: "overspent", slow: 10, fail: 10, want: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			samples := make([]sample, 100)
+			for i := range samples {
+				switch {
+				case i < tt.slow:
+					samples[i].latency = target.threshold
+				case i < tt.slow+tt.fail:
+					samples[i].latency = math.NaN()
+				default:
+					samples[i].latency = target.threshold / 2
+				}
+			}
+			got := computeWindowStats(samples).sloBudgetRemaining(target)
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("%d slow and %d failed probes leave %v of the budget, want %v", tt.slow, tt.fail, got, tt.want)
+			}
+		})
+	}
+	if got := computeWindowStats(nil).sloBudgetRemaining(target); !math.IsNaN(got) {
+		t.Errorf("no probes leave %v of the budget, want NaN", got)
+	}
+}
@@ -0,0 +1,116 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// A dialer for probe connections, applying the configured socket options before connecting.
+// A peer that doesn't answer times out within a tick rather than after the kernel's SYN
+// retries, which would stall the probe loop for minutes.
+func probeDialer() *net.Dialer {
+	d := &net.Dialer{Timeout: conf().LatencyRefreshRate, Control: controlProbeSocket}
+	if port := conf().ProbeSourcePort; port > 0 {
+		d.LocalAddr = &net.TCPAddr{Port: port}
+	}
+	return d
+}
+
+// IPv6 and TCP headers, the largest a segment carries on fly's IPv6 only private network
+const ipv6TcpHeaderBytes = 40 + 20
+
+// The smallest OVERLAY_MTU that leaves segments the kernel's minimum MSS of 88 bytes. It
+// refuses to clamp TCP_MAXSEG below that.
+const minOverlayMtu = ipv6TcpHeaderBytes + 88
+
+func controlProbeSocket(network, address string, raw syscall.RawConn) error {
+	var err error
+	ctrlErr := raw.Control(func(fd uintptr) {
+		err = setProbeSocketOptions(network, int(fd))
+	})
+	if ctrlErr != nil {
+		return ctrlErr
+	}
+	return err
+}
+
+// network is tcp4 or tcp6 once the dialer has picked an address family
+func setProbeSocketOptions(network string, fd int) error {
+	if conf().ProbeSourcePort > 0 {
+		// ECMP routers hash the 4-tuple to pick a path, so a fixed source port keeps successive
+		// probes to a region on the same path. Every probe binds the same port, which needs
+		// reuse allowed, and closes with a reset so no TIME_WAIT holds the 4-tuple until the
+		// next probe.
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+			return err
+		}
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+			return err
+		}
+		if err := unix.SetsockoptLinger(fd, unix.SOL_SOCKET, unix.SO_LINGER, &unix.Linger{Onoff: 1}); err != nil {
+			return err
+		}
+	}
+	if dscp := conf().ProbeDscp; dscp > 0 {
+		// DSCP is the upper six bits of the IPv4 TOS and IPv6 traffic class bytes, leaving ECN alone
+		if network == "tcp4" {
+			err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS, dscp<<2)
+			if err != nil {
+				return err
+			}
+		} else if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, dscp<<2); err != nil {
+			return err
+		}
+	}
+	if mtu := conf().OverlayMtu; mtu > 0 {
+		// Keep every segment within the overlay MTU so anything sent on the connection is
+		// never fragmented. Fragmentation shows up as latency, distorting payload measurements.
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_MAXSEG, mtu-ipv6TcpHeaderBytes); err != nil {
+			return err
+		}
+		// and forbid fragmentation outright so a smaller path MTU is discovered instead
+		if network == "tcp4" {
+			err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO)
+			if err != nil {
+				return err
+			}
+		} else if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_DO); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var pathMtu = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "latency_path_mtu_bytes",
+		Help: "Path MTU the kernel reported for the latest probe connection",
+	},
+	[]string{"to"},
+)
+
+var fragmentationDetected = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "latency_fragmentation_detected",
+		Help: "1 when the path MTU to the region is below the configured overlay MTU",
+	},
+	[]string{"to"},
+)
+
+// A path MTU below the overlay MTU means something between us and the peer can't carry
+// full size packets, which would have been fragmented had fragmentation not been disabled
+func recordPathMtu(r *regionData, info *unix.TCPInfo) {
+	pathMtu.WithLabelValues(r.region).Set(float64(info.Pmtu))
+	if int(info.Pmtu) < conf().OverlayMtu {
+		fragmentationDetected.WithLabelValues(r.region).Set(1)
+	} else {
+		fragmentationDetected.WithLabelValues(r.region).Set(0)
+	}
+}
@@ -0,0 +1,109 @@
+//go:build linux
+
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// An external service target discovered through an SRV record. These don't run the ping
+// server, so they're probed by connecting only.
+type srvTarget struct {
+	service  string
+	priority uint16
+	weight   uint16
+}
+
+var srvTargetInfo = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "latency_srv_target_info",
+		Help: "Set to 1 for each probed SRV target, with the record's priority and weight",
+	},
+	[]string{"to", "service", "priority", "weight"},
+)
+
+func (t *srvTarget) labels(to string) []string {
+	return []string{to, t.service, strconv.Itoa(int(t.priority)), strconv.Itoa(int(t.weight))}
+}
+
+// Look up the SRV records of a service, keeping only the highest priority (lowest value)
+// targets unless all of them should be probed. Weight only matters for spreading load
+// between targets of equal priority, so every target that is kept gets probed.
+func lookupSrvTargets(service string, allPriorities bool) ([]*dns.SRV, error) {
+	resp, err := queryDNS(service, dns.TypeSRV)
+	if err != nil {
+		return nil, err
+	}
+	var records []*dns.SRV
+	for _, rr := range resp.Answer {
+		// a target of "." means the service is decidedly not available
+		if srv, ok := rr.(*dns.SRV); ok && srv.Target != "." {
+			records = append(records, srv)
+		}
+	}
+	if allPriorities || len(records) == 0 {
+		return records, nil
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Priority < records[j].Priority })
+	top := records[0].Priority
+	n := sort.Search(len(records), func(i int) bool { return records[i].Priority > top })
+	return records[:n], nil
+}
+
+// Bring the probed SRV targets in line with the configured services. Targets that are no
+// longer selected stop being probed, but a service whose lookup fails keeps its targets
+// until it can be resolved again.
+func updateSrvTargets(services []string, allPriorities bool) {
+	selected := make(map[string]*srvTarget)
+	failed := make(map[string]bool)
+	for _, service := range services {
+		records, err := lookupSrvTargets(service, allPriorities)
+		if err != nil {
+			log.Printf("SRV lookup for %s failed: %v", service, err)
+			failed[service] = true
+			continue
+		}
+		for _, srv := range records {
+			to := net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+			selected[to] = &srvTarget{service: service, priority: srv.Priority, weight: srv.Weight}
+		}
+	}
+
+	regionsMu.Lock()
+	defer regionsMu.Unlock()
+	for to, r := range regionLatencies {
+		if r.srv == nil || failed[r.srv.service] {
+			continue
+		}
+		if _, ok := selected[to]; !ok {
+			log.Printf("No longer probing SRV target %s of %s", to, r.srv.service)
+			srvTargetInfo.DeleteLabelValues(r.srv.labels(to)...)
+			removeRegion(r)
+		}
+	}
+	for to, t := range selected {
+		r, ok := regionLatencies[to]
+		if ok && r.srv == nil {
+			// a discovered region by the same name takes precedence
+			continue
+		}
+		if !ok {
+			log.Printf("Probing SRV target %s of %s", to, t.service)
+			r = NewRegion(to)
+			r.host = to
+			regionLatencies[to] = r
+		} else if *r.srv != *t {
+			srvTargetInfo.DeleteLabelValues(r.srv.labels(to)...)
+		}
+		r.srv = t
+		srvTargetInfo.WithLabelValues(t.labels(to)...).Set(1)
+	}
+}
@@ -0,0 +1,58 @@
+//go:build linux
+
+package main
+
+import (
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var unsettledTicks = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "latency_stable_probes_unsettled_total",
+		Help: "Ticks whose repeated probes of the region never agreed within StableTolerance",
+	},
+	[]string{"to"},
+)
+
+// whether two consecutive readings are close enough to call the RTT settled
+func settled(prev, latency int, tolerance float64) bool {
+	diff := latency - prev
+	if diff < 0 {
+		diff = -diff
+	}
+	return float64(diff) <= tolerance*float64(prev)
+}
+
+// Probe a region up to StableProbes times in a row, until two consecutive readings agree
+// within StableTolerance, and only then make the latest one the region's last reading. Every
+// reading still goes into the histograms. If the readings never settle the final one is
+// used, so a noisy region keeps reporting.
+func probeUntilStable(r *regionData) {
+	c := conf()
+	prev := -1
+	for i := 0; i < c.StableProbes; i++ {
+		t := resolveProbeTarget(r)
+		if t == nil {
+			return
+		}
+		t.holdLast = true
+		probeTargets(t.timings.addr, []*probeTarget{t})
+		t.done()
+		if !t.measured {
+			// the failure, or the reason the reading was discarded, is already accounted for
+			return
+		}
+		latency := t.timings.rtt
+		if prev >= 0 && settled(prev, latency, c.StableTolerance) {
+			r.recordSuccess(latency)
+			return
+		}
+		prev = latency
+	}
+	log.Printf("Readings of %s didn't settle within %d probes, keeping the last", r.region, c.StableProbes)
+	unsettledTicks.WithLabelValues(r.region).Inc()
+	r.recordSuccess(prev)
+}
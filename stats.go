@@ -0,0 +1,213 @@
+//go:build linux
+
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+	"unsafe"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// One probe outcome. Failed probes are kept as NaN so availability can be computed from the
+// same window as the latency statistics.
+type sample struct {
+	at      time.Time
+	latency float64 // microseconds
+}
+
+// sampleRing holds the most recent samples of a region, overwriting the oldest once full. All
+// windowed statistics are computed from it so there is a single, bounded copy of the data.
+type sampleRing struct {
+	buf   []sample
+	next  int // index the next sample is written to
+	count int
+}
+
+func newSampleRing(capacity int) *sampleRing {
+	return &sampleRing{buf: make([]sample, capacity)}
+}
+
+// The configured ring size, or by default enough room for every probe in the window with
+// headroom for ticks that run late. A smaller ring bounds memory at the cost of the window
+// only covering the most recent samples.
+func statsRingCapacity(c *config) int {
+	if c.StatsRingSize > 0 {
+		return c.StatsRingSize
+	}
+	return 2*int(c.StatsWindow/c.LatencyRefreshRate) + 1
+}
+
+// bytes allocated for the ring's samples
+func (s *sampleRing) footprint() int {
+	return len(s.buf) * int(unsafe.Sizeof(sample{}))
+}
+
+// overwrites the oldest sample once full, so adding never costs more than a single write
+func (s *sampleRing) add(smp sample) {
+	s.buf[s.next] = smp
+	s.next = (s.next + 1) % len(s.buf)
+	if s.count < len(s.buf) {
+		s.count++
+	}
+}
+
+// the samples taken after t, oldest first
+func (s *sampleRing) since(t time.Time) []sample {
+	samples := make([]sample, 0, s.count)
+	for i := 0; i < s.count; i++ {
+		smp := s.buf[(s.next-s.count+i+len(s.buf))%len(s.buf)]
+		if smp.at.After(t) {
+			samples = append(samples, smp)
+		}
+	}
+	return samples
+}
+
+// the samples within the configured stats window
+func (s *sampleRing) window() []sample {
+	return s.since(time.Now().Add(-conf().StatsWindow))
+}
+
+var windowQuantiles = []float64{0.5, 0.9, 0.99}
+
+// Statistics over a window of samples. Latency statistics only cover successful probes and are
+// NaN when there were none.
+type windowStats struct {
+	probes       int
+	availability float64
+	mean         float64
+	stddev       float64
+	quantiles    []float64 // matching windowQuantiles
+	sorted       []float64 // successful latencies, ascending
+}
+
+func computeWindowStats(samples []sample) windowStats {
+	st := windowStats{probes: len(samples), availability: math.NaN(), mean: math.NaN(), stddev: math.NaN()}
+	for _, smp := range samples {
+		if !math.IsNaN(smp.latency) {
+			st.sorted = append(st.sorted, smp.latency)
+		}
+	}
+	st.quantiles = make([]float64, len(windowQuantiles))
+	for i := range st.quantiles {
+		st.quantiles[i] = math.NaN()
+	}
+	if st.probes == 0 {
+		return st
+	}
+	st.availability = float64(len(st.sorted)) / float64(st.probes)
+	if len(st.sorted) == 0 {
+		return st
+	}
+
+	sort.Float64s(st.sorted)
+	var sum float64
+	for _, l := range st.sorted {
+		sum += l
+	}
+	st.mean = sum / float64(len(st.sorted))
+	var squares float64
+	for _, l := range st.sorted {
+		squares += (l - st.mean) * (l - st.mean)
+	}
+	st.stddev = math.Sqrt(squares / float64(len(st.sorted)))
+	for i, q := range windowQuantiles {
+		st.quantiles[i] = st.quantile(q)
+	}
+	return st
+}
+
+// nearest rank quantile of the successful latencies
+func (st windowStats) quantile(q float64) float64 {
+	if len(st.sorted) == 0 {
+		return math.NaN()
+	}
+	rank := int(math.Ceil(q*float64(len(st.sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return st.sorted[rank]
+}
+
+// the statistics for a region's current window
+func (r *regionData) windowStats() windowStats {
+	regionsMu.RLock()
+	samples := r.samples.window()
+	regionsMu.RUnlock()
+	return computeWindowStats(samples)
+}
+
+// windowCollector exports every region's windowed statistics, computed when scraped
+type windowCollector struct {
+	mean         *prometheus.Desc
+	stddev       *prometheus.Desc
+	quantile     *prometheus.Desc
+	availability *prometheus.Desc
+	samples      *prometheus.Desc
+	memory       *prometheus.Desc
+	sloBudget    *prometheus.Desc
+}
+
+func newWindowCollector() *windowCollector {
+	return &windowCollector{
+		mean: prometheus.NewDesc("latency_window_mean_microseconds",
+			"Mean TCP_INFO RTT over the stats window", []string{"to"}, nil),
+		stddev: prometheus.NewDesc("latency_window_stddev_microseconds",
+			"Standard deviation of the TCP_INFO RTT over the stats window", []string{"to"}, nil),
+		quantile: prometheus.NewDesc("latency_window_quantile_microseconds",
+			"TCP_INFO RTT quantiles over the stats window", []string{"to", "quantile"}, nil),
+		availability: prometheus.NewDesc("latency_window_availability_ratio",
+			"Fraction of probes over the stats window that produced a reading", []string{"to"}, nil),
+		sloBudget: prometheus.NewDesc("latency_slo_budget_remaining",
+			"Fraction of the region's SLO error budget left over the stats window", []string{"to"}, nil),
+		samples: prometheus.NewDesc("latency_stats_samples",
+			"Samples held for the windowed statistics across all regions", nil, nil),
+		memory: prometheus.NewDesc("latency_stats_memory_bytes",
+			"Memory allocated for windowed statistics samples across all regions", nil, nil),
+	}
+}
+
+func (wc *windowCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- wc.mean
+	ch <- wc.stddev
+	ch <- wc.quantile
+	ch <- wc.availability
+	ch <- wc.sloBudget
+	ch <- wc.samples
+	ch <- wc.memory
+}
+
+func (wc *windowCollector) Collect(ch chan<- prometheus.Metric) {
+	var samples, memory int
+	for _, r := range snapshotRegions() {
+		regionsMu.RLock()
+		samples += r.samples.count
+		memory += r.samples.footprint()
+		regionsMu.RUnlock()
+
+		st := r.windowStats()
+		if st.probes == 0 {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(wc.availability, prometheus.GaugeValue, st.availability, r.region)
+		if target, ok := conf().sloTarget(r.region); ok {
+			ch <- prometheus.MustNewConstMetric(wc.sloBudget, prometheus.GaugeValue, st.sloBudgetRemaining(target), r.region)
+		}
+		ch <- prometheus.MustNewConstMetric(wc.mean, prometheus.GaugeValue, st.mean, r.region)
+		ch <- prometheus.MustNewConstMetric(wc.stddev, prometheus.GaugeValue, st.stddev, r.region)
+		for i, q := range windowQuantiles {
+			ch <- prometheus.MustNewConstMetric(wc.quantile, prometheus.GaugeValue, st.quantiles[i],
+				r.region, strconv.FormatFloat(q, 'g', -1, 64))
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(wc.samples, prometheus.GaugeValue, float64(samples))
+	ch <- prometheus.MustNewConstMetric(wc.memory, prometheus.GaugeValue, float64(memory))
+}
+
+func init() {
+	prometheus.MustRegister(newWindowCollector())
+}
@@ -0,0 +1,178 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"unicode"
+)
+
+// A target added by an operator rather than discovered, for keeping an eye on an ad-hoc
+// endpoint. Like SRV targets they needn't run the ping server, so they're probed by
+// connecting only.
+type staticTarget struct {
+	Name string `json:"name"`
+	Host string `json:"host"` // host:port to connect to
+}
+
+// targetsMu serializes changes to the static targets so the targets file is written in order
+var targetsMu sync.Mutex
+
+// whether the region is probed by connecting only, being outside the deployment
+func (r *regionData) external() bool {
+	return r.srv != nil || r.static
+}
+
+// the static targets being probed, sorted by name
+func staticTargets() []staticTarget {
+	targets := []staticTarget{}
+	for _, r := range snapshotRegions() {
+		if r.static {
+			targets = append(targets, staticTarget{Name: r.region, Host: r.host})
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Name < targets[j].Name })
+	return targets
+}
+
+var errTargetExists = errors.New("a region or target by that name already exists")
+
+// Start probing a static target, naming it after its host if it has no name. Its name
+// mustn't clash with any other region or target.
+func addStaticTarget(t *staticTarget) error {
+	if _, _, err := net.SplitHostPort(t.Host); err != nil {
+		return err
+	}
+	if len(t.Name) == 0 {
+		t.Name = t.Host
+	}
+	// the name is a label value and a field of the tab separated output of /
+	for _, c := range t.Name {
+		if unicode.IsSpace(c) || unicode.IsControl(c) {
+			return fmt.Errorf("target name %q contains %q", t.Name, c)
+		}
+	}
+	regionsMu.Lock()
+	defer regionsMu.Unlock()
+	if _, ok := regionLatencies[t.Name]; ok {
+		return errTargetExists
+	}
+	r := NewRegion(t.Name)
+	r.host = t.Host
+	r.static = true
+	regionLatencies[t.Name] = r
+	return nil
+}
+
+// Stop probing a static target, returning whether there was one by that name
+func removeStaticTarget(name string) bool {
+	regionsMu.Lock()
+	defer regionsMu.Unlock()
+	r, ok := regionLatencies[name]
+	if !ok || !r.static {
+		return false
+	}
+	removeRegion(r)
+	return true
+}
+
+// Add the static targets saved in path. A missing file just means none were saved yet.
+func loadStaticTargets(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var targets []staticTarget
+	if err := json.Unmarshal(data, &targets); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, t := range targets {
+		if err := addStaticTarget(&t); err != nil {
+			return fmt.Errorf("%s: target %q: %w", path, t.Name, err)
+		}
+	}
+	log.Printf("Probing %d static targets from %s", len(targets), path)
+	return nil
+}
+
+// Save the static targets to path, through a temporary file so a crash can't leave it
+// half written
+func saveStaticTargets(path string) error {
+	data, err := json.MarshalIndent(staticTargets(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// handler for /targets: GET lists the static targets, POST adds the one in the JSON body and
+// DELETE removes the one named by the name parameter. Changes take effect on the next tick and
+// are saved to TargetsFile when one is set.
+func handleTargets(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	targetsMu.Lock()
+	defer targetsMu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var t staticTarget
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := addStaticTarget(&t); errors.Is(err, errTargetExists) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Static target %s at %s added by %s", t.Name, t.Host, r.RemoteAddr)
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		if !removeStaticTarget(name) {
+			http.Error(w, "no such static target", http.StatusNotFound)
+			return
+		}
+		log.Printf("Static target %s removed by %s", name, r.RemoteAddr)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if path := conf().TargetsFile; len(path) > 0 && r.Method != http.MethodGet {
+		if err := saveStaticTargets(path); err != nil {
+			log.Printf("Unable to save static targets to %s: %v", path, err)
+			http.Error(w, "applied, but not saved: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(staticTargets())
+}
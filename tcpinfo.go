@@ -0,0 +1,66 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Look up TCPINFO_FIELDS, comma separated unix.TCPInfo field names matched case
+// insensitively, returning the index of each field. A field listed more than once is only
+// returned once, as each gets a gauge of its own.
+func parseTcpInfoFields(v string) ([]int, error) {
+	t := reflect.TypeOf(unix.TCPInfo{})
+	var fields []int
+	seen := make(map[int]bool)
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		f, ok := t.FieldByNameFunc(func(field string) bool { return strings.EqualFold(field, name) })
+		if !ok || len(f.Index) != 1 {
+			return nil, fmt.Errorf("unix.TCPInfo has no field %q", name)
+		}
+		switch f.Type.Kind() {
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		default:
+			return nil, fmt.Errorf("unix.TCPInfo field %s isn't a number", f.Name)
+		}
+		if !seen[f.Index[0]] {
+			seen[f.Index[0]] = true
+			fields = append(fields, f.Index[0])
+		}
+	}
+	return fields, nil
+}
+
+// A gauge per configured TCP_INFO field, matching tcpInfoFields. Created by
+// initTcpInfoMetrics.
+var tcpInfoGauges []*prometheus.GaugeVec
+
+func initTcpInfoMetrics(c *config) {
+	t := reflect.TypeOf(unix.TCPInfo{})
+	for _, i := range c.tcpInfoFields {
+		name := t.Field(i).Name
+		tcpInfoGauges = append(tcpInfoGauges, promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "latency_tcpinfo_" + strings.ToLower(name),
+				Help: fmt.Sprintf("TCP_INFO field %s of the latest probe connection", name),
+			},
+			[]string{"to"},
+		))
+	}
+}
+
+// set the configured fields' gauges from a probe connection's TCP_INFO
+func recordTcpInfoFields(r *regionData, info *unix.TCPInfo) {
+	v := reflect.ValueOf(info).Elem()
+	for n, i := range conf().tcpInfoFields {
+		tcpInfoGauges[n].WithLabelValues(r.region).Set(float64(v.Field(i).Uint()))
+	}
+}
@@ -0,0 +1,53 @@
+//go:build linux
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseTcpInfoFields(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string // field names, nil when the value should be rejected
+	}{
+		{value: "Rtt", want: []string{"Rtt"}},
+		{value: "rtt,rttvar", want: []string{"Rtt", "Rttvar"}},
+		{value: " Total_Retrans , SND_CWND", want: []string{"Total_retrans", "Snd_cwnd"}},
+		{value: "state,Lost", want: []string{"State", "Lost"}},
+		{value: "rtt,Rtt,RTT", want: []string{"Rtt"}},
+		{value: "lost,rtt,lost", want: []string{"Lost", "Rtt"}},
+		{value: ""},
+		{value: "rtt,"},
+		{value: "rtt,,lost"},
+		{value: "latency"},
+		{value: "rtt,latency"},
+		{value: "snd cwnd"},
+		{value: "sndcwnd"},
+	}
+	info := reflect.TypeOf(unix.TCPInfo{})
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			fields, err := parseTcpInfoFields(tt.value)
+			if tt.want == nil {
+				if err == nil {
+					t.Errorf("parseTcpInfoFields(%q) = %v, want an error", tt.value, fields)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTcpInfoFields(%q): %v", tt.value, err)
+			}
+			var got []string
+			for _, i := range fields {
+				got = append(got, info.Field(i).Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTcpInfoFields(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,21 @@
+//go:build linux
+
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Periodically write every metric to path in the Prometheus text format, for the
+// node_exporter textfile collector. WriteToTextfile writes a temporary file and renames it
+// into place, so the collector never reads a partial file.
+func writeTextfile(path string, ticker *time.Ticker) {
+	for range ticker.C {
+		if err := prometheus.WriteToTextfile(path, prometheus.DefaultGatherer); err != nil {
+			log.Printf("Unable to write metrics to %s: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+//go:build linux
+
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+var processStart = time.Now()
+
+// Whether the process is still within WarmupPeriod of starting. Readings taken while warming
+// up are discarded, since anything observed into the cumulative histograms stays there for
+// the life of the process.
+func warmingUp() bool {
+	return time.Since(processStart) < conf().WarmupPeriod
+}
+
+// /ready answers 503 until warmup is over, so traffic and scrapes can wait for clean data
+func getReady(w http.ResponseWriter, r *http.Request) {
+	if warmingUp() {
+		http.Error(w, "warming up", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ready"))
+}